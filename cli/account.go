@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"simpleblockchain/dao"
+	"simpleblockchain/node"
+	"text/tabwriter"
+	"time"
+)
+
+const flagOffset = "offset"
+const flagLimit = "limit"
+const flagDirection = "direction"
+
+func AccountCmd() *cobra.Command {
+	var accountCmd = &cobra.Command{
+		Use:   "account",
+		Short: "Look into the accounts on the chain (history...).",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return IncorrectUsageErr()
+		},
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			openState(true)
+		},
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {
+			closeState()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+
+	accountCmd.AddCommand(accountHistoryCmd())
+
+	return accountCmd
+}
+
+func accountHistoryCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "history <account>",
+		Short: "Shows what the account has paid and been paid, newest first.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			offset, _ := cmd.Flags().GetUint(flagOffset)
+			limit, _ := cmd.Flags().GetUint(flagLimit)
+			rawDirection, _ := cmd.Flags().GetString(flagDirection)
+
+			account, err := dao.ParseAccount(args[0])
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			direction, err := dao.ParseTxDirection(rawDirection)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			if limit == 0 || limit > node.MaxAccountTxsLimit {
+				_, _ = fmt.Fprintf(os.Stderr, "--%s must be from 1 to %d\n", flagLimit, node.MaxAccountTxsLimit)
+				return
+			}
+
+			var res node.AccountTxsRes
+			if conn == nil {
+				res, err = node.AccountTxs(account, direction, int(offset), int(limit), state)
+			} else {
+				endpoint := fmt.Sprintf("%s%s%s?%s=%d&%s=%d&%s=%s", node.EndpointAccounts, account, node.EndpointAccountTxs,
+					node.EndpointAccountTxsQueryKeyOffset, offset, node.EndpointAccountTxsQueryKeyLimit, limit,
+					node.EndpointAccountTxsQueryKeyDirection, direction)
+				err = getFromNode(endpoint, &res)
+			}
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+
+			if len(res.TXs) == 0 {
+				fmt.Printf("There are no more of the %d TXs of %s\n", res.Total, res.Account)
+				return
+			}
+			fmt.Printf("TXs %d to %d of the %d TXs of %s:\n", res.Offset+1, res.Offset+len(res.TXs), res.Total, res.Account)
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "Block\tTime\tCounterparty\tValue\tFee\tMemo")
+			for _, tx := range res.TXs {
+				mined := time.Unix(int64(tx.Time), 0).UTC().Format(time.RFC3339)
+				// The fee is only paid by the sender
+				value, fee := fmt.Sprintf("+%d", tx.Value), ""
+				switch tx.Direction {
+				case dao.TxOut:
+					value, fee = fmt.Sprintf("-%d", tx.Value), fmt.Sprint(tx.Fee)
+				case dao.TxSelf:
+					value, fee = fmt.Sprint(tx.Value), fmt.Sprint(tx.Fee)
+				}
+				counterparty := string(tx.Counterparty)
+				if counterparty == "" {
+					counterparty = "(mined)"
+				}
+				_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", tx.BlockNumber, mined, counterparty, value, fee, tx.Data)
+			}
+			_ = w.Flush()
+		},
+	}
+
+	cmd.Flags().Uint(flagOffset, 0, "How many of the newest TXs to skip")
+	cmd.Flags().Uint(flagLimit, node.DefaultAccountTxsLimit, fmt.Sprintf("How many TXs to show, at most %d", node.MaxAccountTxsLimit))
+	cmd.Flags().String(flagDirection, "all", "Only show the TXs 'in' to or 'out' of the account, or 'all' of them")
+
+	return cmd
+}
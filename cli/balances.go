@@ -4,12 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/spf13/cobra"
-	"net/http"
 	"os"
+	"simpleblockchain/dao"
 	"simpleblockchain/node"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const flagAt = "at"
+
 var balances node.BalancesRes
 
 func BalancesCmd() *cobra.Command {
@@ -20,9 +24,10 @@ func BalancesCmd() *cobra.Command {
 			return ErrIncorrectUsage
 		},
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			openState()
+			openState(true)
+			at, _ := cmd.Flags().GetString(flagAt)
 			var err error
-			balances, err = getBalances()
+			balances, err = getBalances(at)
 			if err != nil {
 				_, _ = fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
@@ -35,6 +40,8 @@ func BalancesCmd() *cobra.Command {
 		},
 	}
 
+	balancesCmd.PersistentFlags().String(flagAt, "", "Show the balances as they were after the block with this height or hash")
+
 	balancesCmd.AddCommand(balancesListCmd)
 	balancesCmd.AddCommand(balancesStateCmd)
 
@@ -46,6 +53,10 @@ var balancesListCmd = &cobra.Command{
 	Short: "Lists all balances.",
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Printf("Accounts balances at %s:\n", balances.Hash.Hex())
+		if !balances.Hash.IsEmpty() {
+			mined := time.Unix(int64(balances.Time), 0).UTC().Format(time.RFC3339)
+			fmt.Printf("After block %d mined at %s\n", balances.BlockNumber, mined)
+		}
 		var maxAccountLen int = 7
 		for account := range balances.Balances {
 			if len(account) > maxAccountLen {
@@ -74,26 +85,43 @@ var balancesStateCmd = &cobra.Command{
 	},
 }
 
-func getBalances() (node.BalancesRes, error) {
+// The latest balances, or those after the block at, which is a height or a hash
+func getBalances(at string) (node.BalancesRes, error) {
+	var height uint64
+	blockHash := dao.Hash{}
+	atHeight := false
+	if at != "" {
+		var err error
+		height, err = strconv.ParseUint(at, 10, 64)
+		atHeight = err == nil && len(at) < len(dao.Hash{})*2
+		if !atHeight {
+			if err := blockHash.UnmarshalText([]byte(at)); err != nil || blockHash.IsEmpty() {
+				return node.BalancesRes{}, fmt.Errorf("'%s' is neither a block height nor a block hash", at)
+			}
+		}
+	}
+
 	// If we don't have a connection to the server then
 	// we directly call the blockchain routines
 	if conn == nil {
-		return node.BalancesRes{
-			Hash:     state.LatestBlockHash(),
-			Balances: state.Balances,
-		}, nil
+		switch {
+		case atHeight:
+			return node.BalancesAtHeight(height, state)
+		case !blockHash.IsEmpty():
+			return node.BalancesAtHash(blockHash, state)
+		}
+		return node.LatestBalances(state), nil
 	}
+
 	// Get the balancees from the server
-	url := fmt.Sprintf("http://%s%s", thisPeerNode.TcpAddress(), node.EndpointBalancesList)
-	resp, err := http.Get(url)
-	var b node.BalancesRes = node.BalancesRes{}
-	if err != nil {
-		return b, fmt.Errorf("Error requesting balances: %w", err)
-	}
-	defer resp.Body.Close()
-	err = json.NewDecoder(resp.Body).Decode(&b)
-	if err != nil {
-		return b, fmt.Errorf("Couldn't decode the json %v: %w", resp.Body, err)
+	endpoint := node.EndpointBalancesList
+	switch {
+	case atHeight:
+		endpoint = fmt.Sprintf("%s?%s=%d", endpoint, node.EndpointBalancesListQueryKeyBlock, height)
+	case !blockHash.IsEmpty():
+		endpoint = fmt.Sprintf("%s?%s=%s", endpoint, node.EndpointBalancesListQueryKeyHash, blockHash.Hex())
 	}
-	return b, nil
+	var b node.BalancesRes = node.BalancesRes{}
+	err := getFromNode(endpoint, &b)
+	return b, err
 }
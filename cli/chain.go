@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"simpleblockchain/node"
+)
+
+func ChainCmd() *cobra.Command {
+	var chainCmd = &cobra.Command{
+		Use:   "chain",
+		Short: "Maintain the local copy of the chain (snapshot...).",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return IncorrectUsageErr()
+		},
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			openState(false)
+		},
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {
+			closeState()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+
+	chainCmd.AddCommand(chainSnapshotCmd())
+
+	return chainCmd
+}
+
+func chainSnapshotCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "snapshot",
+		Short: "Takes a snapshot of the balances so they're loaded without replaying every block.",
+		Run: func(cmd *cobra.Command, args []string) {
+			var res node.ChainSnapshotRes
+			if conn == nil {
+				blockFs, err := state.Snapshot()
+				if err != nil {
+					_, _ = fmt.Fprintln(os.Stderr, err)
+					return
+				}
+				res = node.ChainSnapshotRes{BlockNumber: blockFs.Value.Header.BlockNumber, BlockHash: blockFs.Key}
+			} else {
+				err := postToNode(node.EndpointChainSnapshot, nil, &res)
+				if err != nil {
+					_, _ = fmt.Fprintln(os.Stderr, err)
+					return
+				}
+			}
+
+			fmt.Printf("Snapshot taken of block %d '%s'\n", res.BlockNumber, res.BlockHash.Hex())
+		},
+	}
+
+	return cmd
+}
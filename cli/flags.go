@@ -5,11 +5,14 @@ import (
 	"github.com/spf13/cobra"
 	"os"
 	"path"
+	"simpleblockchain/dao"
 )
 
 const flagDataDir = "datadir"
+const flagGenesisTemplate = "genesis-template"
 
 var dataDir string
+var genesisTemplate string
 
 func AddGlobalFlags(cmd *cobra.Command) {
 	// get current working directory or error
@@ -23,4 +26,16 @@ func AddGlobalFlags(cmd *cobra.Command) {
 	defaultDataDir := path.Join(cwd, "data")
 	// Persistent flag is global
 	cmd.PersistentFlags().StringVarP(&dataDir, "datadir", "f", defaultDataDir, "Absolute path to the node data dir where the DB will be/is stored")
+	cmd.PersistentFlags().StringVar(&genesisTemplate, flagGenesisTemplate, "", "A template file to write new genesis files with instead of the built in one")
+}
+
+// Write new genesis files with the --genesis-template file when there is one
+func useGenesisTemplate() {
+	if genesisTemplate == "" {
+		return
+	}
+	if err := dao.SetGenesisTemplate(genesisTemplate); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,154 @@
+package cli
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"simpleblockchain/dao"
+	"strconv"
+	"strings"
+)
+
+const flagChainID = "chain-id"
+const flagAlloc = "alloc"
+const flagAllocFile = "alloc-file"
+const flagDifficulty = "difficulty"
+const flagRetargetInterval = "retarget-interval"
+const flagBlockTime = "block-time"
+const flagBlockReward = "block-reward"
+const flagMaxTimeDrift = "max-time-drift"
+const flagMinFee = "min-fee"
+
+func GenesisCmd() *cobra.Command {
+	var genesisCmd = &cobra.Command{
+		Use:   "genesis",
+		Short: "Create the genesis file that starts a new chain (init...).",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return IncorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+
+	genesisCmd.AddCommand(genesisInitCmd())
+
+	return genesisCmd
+}
+
+func genesisInitCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "init",
+		Short: "Writes a genesis file with the first balances and chain parameters to the data dir.",
+		Run: func(cmd *cobra.Command, args []string) {
+			chainID, _ := cmd.Flags().GetString(flagChainID)
+			allocs, _ := cmd.Flags().GetStringArray(flagAlloc)
+			allocFile, _ := cmd.Flags().GetString(flagAllocFile)
+
+			balances := make(dao.Balances)
+			if allocFile != "" {
+				err := readAllocFile(allocFile, balances)
+				if err != nil {
+					_, _ = fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
+			for _, alloc := range allocs {
+				parts := strings.SplitN(alloc, "=", 2)
+				if len(parts) != 2 {
+					_, _ = fmt.Fprintf(os.Stderr, "--%s '%s' must be account=amount\n", flagAlloc, alloc)
+					os.Exit(1)
+				}
+				err := addAlloc(balances, parts[0], parts[1])
+				if err != nil {
+					_, _ = fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
+
+			gen := dao.NewGenesis(chainID, balances)
+			gen.Difficulty, _ = cmd.Flags().GetUint32(flagDifficulty)
+			gen.RetargetInterval, _ = cmd.Flags().GetUint64(flagRetargetInterval)
+			gen.BlockTime, _ = cmd.Flags().GetUint64(flagBlockTime)
+			gen.BlockReward, _ = cmd.Flags().GetUint(flagBlockReward)
+			gen.MaxTimeDrift, _ = cmd.Flags().GetUint64(flagMaxTimeDrift)
+			gen.MinFee, _ = cmd.Flags().GetUint(flagMinFee)
+
+			useGenesisTemplate()
+			hash, err := dao.WriteGenesis(dataDir, gen)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Genesis of chain '%s' with %d accounts written to %s\n", chainID, len(balances), dao.GetGenesisJsonFilePath(dataDir))
+			fmt.Printf("Genesis hash %s\n", hash.Hex())
+		},
+	}
+
+	cmd.Flags().String(flagChainID, "", "The name of the new chain")
+	_ = cmd.MarkFlagRequired(flagChainID)
+
+	cmd.Flags().StringArray(flagAlloc, []string{}, "The first balance of an account as account=amount, repeat it for each account")
+	cmd.Flags().String(flagAllocFile, "", "A csv file of account,amount lines with the first balances")
+	cmd.Flags().Uint32(flagDifficulty, dao.DefaultDifficulty, "How many leading zero bits the hash of the first blocks needs")
+	cmd.Flags().Uint64(flagRetargetInterval, dao.DefaultRetargetInterval, "How many blocks between changes of the difficulty")
+	cmd.Flags().Uint64(flagBlockTime, dao.DefaultBlockTime, "The target number of seconds between blocks")
+	cmd.Flags().Uint(flagBlockReward, dao.DefaultBlockReward, "The most a miner can reward themselves for a block")
+	cmd.Flags().Uint64(flagMaxTimeDrift, dao.DefaultMaxTimeDrift, "How many seconds a block can be ahead of a node's clock")
+	cmd.Flags().Uint(flagMinFee, dao.DefaultMinFee, "The least a transaction must pay the miner")
+
+	return cmd
+}
+
+// Read the account,amount lines of the csv file
+// A first line of account,amount is taken as a heading and lines starting with # are ignored
+func readAllocFile(path string, balances dao.Balances) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Cannot open the allocations: %w", err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot read the allocations: %w", err)
+		}
+		if first && strings.EqualFold(record[0], "account") {
+			continue
+		}
+
+		err = addAlloc(balances, record[0], record[1])
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+}
+
+func addAlloc(balances dao.Balances, account string, amount string) error {
+	parsedAccount, err := dao.ParseAccount(strings.TrimSpace(account))
+	if err != nil {
+		return err
+	}
+	if _, ok := balances[parsedAccount]; ok {
+		return fmt.Errorf("account %s is allocated a balance twice", parsedAccount)
+	}
+
+	parsedAmount, err := strconv.ParseUint(strings.TrimSpace(amount), 10, 0)
+	if err != nil {
+		return fmt.Errorf("the amount '%s' for %s must be a whole number", amount, parsedAccount)
+	}
+
+	balances[parsedAccount] = uint(parsedAmount)
+	return nil
+}
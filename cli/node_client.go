@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"simpleblockchain/node"
+)
+
+// Send a GET request to the node we're routing commands to
+func getFromNode(endpoint string, res interface{}) error {
+	url := fmt.Sprintf("http://%s%s", thisPeerNode.TcpAddress(), endpoint)
+	resp, err := http.Get(url)
+	if err != nil {
+		return fmt.Errorf("Error requesting %s: %w", endpoint, err)
+	}
+
+	return readNodeRes(resp, res)
+}
+
+// Send a POST request with a JSON body to the node we're routing commands to
+func postToNode(endpoint string, req interface{}, res interface{}) error {
+	url := fmt.Sprintf("http://%s%s", thisPeerNode.TcpAddress(), endpoint)
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("Cannot convert to json %v: %w", req, err)
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(reqJson))
+	if err != nil {
+		return fmt.Errorf("Error posting to %s: %w", endpoint, err)
+	}
+
+	return readNodeRes(resp, res)
+}
+
+// The node replies with an ErrRes when something goes wrong
+func readNodeRes(resp *http.Response, res interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errRes := node.ErrRes{}
+		err := json.NewDecoder(resp.Body).Decode(&errRes)
+		if err != nil || errRes.Error == "" {
+			return fmt.Errorf("Node replied with %s", resp.Status)
+		}
+		return errors.New(errRes.Error)
+	}
+
+	err := json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		return fmt.Errorf("Couldn't decode the json: %w", err)
+	}
+	return nil
+}
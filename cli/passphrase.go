@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"strings"
+)
+
+// Passphrases are read from the terminal without echoing them
+// When stdin isn't a terminal, e.g. in a script, each passphrase is read as a line
+var stdin = bufio.NewReader(os.Stdin)
+
+func readPassphrase(prompt string) (string, error) {
+	_, _ = fmt.Fprint(os.Stderr, prompt)
+
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		_, _ = fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("Cannot read the passphrase: %w", err)
+		}
+		return string(passphrase), nil
+	}
+
+	passphrase, err := stdin.ReadString('\n')
+	_, _ = fmt.Fprintln(os.Stderr)
+	if err != nil && passphrase == "" {
+		return "", fmt.Errorf("Cannot read the passphrase: %w", err)
+	}
+	return strings.TrimRight(passphrase, "\r\n"), nil
+}
+
+// A new passphrase is asked for twice to catch a typo that would lock the key away
+func readNewPassphrase(prompt string) (string, error) {
+	passphrase, err := readPassphrase(prompt)
+	if err != nil {
+		return "", err
+	}
+
+	repeated, err := readPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != repeated {
+		return "", fmt.Errorf("The passphrases don't match")
+	}
+
+	return passphrase, nil
+}
@@ -4,12 +4,20 @@ import (
 	"fmt"
 	"github.com/spf13/cobra"
 	"os"
+	"simpleblockchain/dao"
 	"simpleblockchain/node"
 )
 
+const flagMiner = "miner"
+const flagFsync = "fsync"
+const flagStore = "store"
+
 var (
-	ip   string
-	port uint64
+	ip    string
+	port  uint64
+	miner string
+	fsync string
+	store string
 )
 
 func RunCmd() *cobra.Command {
@@ -17,7 +25,15 @@ func RunCmd() *cobra.Command {
 		Use:   "run",
 		Short: "Launches the TBB node and its HTTP API.",
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			openState()
+			if store != "" {
+				var err error
+				storeKind, err = dao.ParseStoreKind(store)
+				if err != nil {
+					_, _ = fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
+			openState(false)
 		},
 		PersistentPostRun: func(cmd *cobra.Command, args []string) {
 			closeState()
@@ -30,8 +46,25 @@ func RunCmd() *cobra.Command {
 			// Everyone registers with bootstrap
 			bootstrap := node.NewPeerNode("127.0.0.1", 8080, true, false)
 
-			n := node.New(state, ip, port, bootstrap)
-			err := n.Run()
+			minerAccount := dao.NewAccount(miner)
+			if miner != "" {
+				var err error
+				minerAccount, err = dao.ParseAccount(miner)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+
+			syncPolicy, err := dao.ParseSyncPolicy(fsync)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			state.SetSyncPolicy(syncPolicy)
+
+			n := node.New(state, ip, port, minerAccount, bootstrap)
+			err = n.Run()
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
@@ -41,6 +74,9 @@ func RunCmd() *cobra.Command {
 
 	runCmd.Flags().Uint64VarP(&port, "port", "p", node.DefaultHTTPort, "exposed HTTP port for communication with peers")
 	runCmd.Flags().StringVar(&ip, "ip", node.DefaultIP, "exposed IP for communication with peers")
+	runCmd.Flags().StringVar(&fsync, flagFsync, string(dao.SyncAlways), "when blocks are flushed to the disk, 'always' so a crash can't lose them or 'never' to leave it to the OS")
+	runCmd.Flags().StringVar(&store, flagStore, "", "how the blocks are stored, 'json', 'segmented' or 'memory', the store already in the data dir by default and 'json' for a new one")
+	runCmd.Flags().StringVar(&miner, flagMiner, "", "account address rewarded for mining blocks, the node doesn't mine without one")
 
 	return runCmd
 }
@@ -10,12 +10,14 @@ import (
 )
 
 var state *dao.State
+var storeKind dao.StoreKind // The block store to open, empty for the one in the data dir
 var thisPeerNode node.PeerNode
 var conn net.Conn
 
 // Establish the current state by starting at genesis
 // and applying any existing transactions
-func openState() {
+// A read only state is for commands that only inspect the chain, they can share the data dir.
+func openState(readOnly bool) {
 	var err error
 	// First of all are we running as a network service or not?
 	thisPeerNode, _ = node.LoadThisPeerNoce(dataDir)
@@ -33,7 +35,12 @@ func openState() {
 	}
 
 	if conn == nil {
-		state, err = dao.LoadStateFromDisk(dataDir)
+		useGenesisTemplate()
+		if readOnly {
+			state, err = dao.LoadStateReadOnly(dataDir)
+		} else {
+			state, err = dao.LoadStateWithStore(dataDir, storeKind)
+		}
 		if err != nil {
 			_, _ = fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
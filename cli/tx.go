@@ -1,31 +1,32 @@
 package cli
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/spf13/cobra"
-	"net/http"
 	"os"
 	"simpleblockchain/dao"
 	"simpleblockchain/node"
-	"time"
+	"simpleblockchain/wallet"
 )
 
 const flagFrom = "from"
 const flagTo = "to"
 const flagValue = "value"
+const flagFee = "fee"
 const flagData = "data"
 
 func TxCmd() *cobra.Command {
 	var txsCmd = &cobra.Command{
 		Use:   "tx",
-		Short: "Interact with txs (add...).",
+		Short: "Interact with txs (add, show, proof...).",
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			return IncorrectUsageErr()
 		},
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			openState()
+			// Only adding a TX writes to the data dir
+			openState(cmd.Name() != "add")
 		},
 		PersistentPostRun: func(cmd *cobra.Command, args []string) {
 			closeState()
@@ -35,6 +36,8 @@ func TxCmd() *cobra.Command {
 	}
 
 	txsCmd.AddCommand(txAddCmd())
+	txsCmd.AddCommand(txShowCmd())
+	txsCmd.AddCommand(txProofCmd())
 
 	return txsCmd
 }
@@ -47,81 +50,202 @@ func txAddCmd() *cobra.Command {
 			from, _ := cmd.Flags().GetString(flagFrom)
 			to, _ := cmd.Flags().GetString(flagTo)
 			value, _ := cmd.Flags().GetUint(flagValue)
+			fee, _ := cmd.Flags().GetUint(flagFee)
 			data, _ := cmd.Flags().GetString(flagData)
+			miner, _ := cmd.Flags().GetString(flagMiner)
 
-			tx := dao.NewTx(dao.NewAccount(from), dao.NewAccount(to), value, data)
-			var txAddRes node.TxAddRes
+			// Catch a mistyped address before the tokens are lost
+			toAccount, err := dao.ParseAccount(to)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+
+			// Only the owner of the account can send from it
+			fromAccount, err := dao.ParseAccount(from)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", fromAccount))
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			key, err := wallet.LoadKey(dataDir, fromAccount, passphrase)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			nonce, err := getNextNonce(fromAccount)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			tx, err := key.SignTx(dao.NewTx(fromAccount, toAccount, nonce, value, fee, data))
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+
+			txHash := tx.Hash()
 
 			// If we don't have a connection to the server then
 			// we directly call the blockchain routines
 			if conn == nil {
-				block := dao.NewBlock(
-					state.LatestBlockHash(),
-					state.NextBlockNumber(),
-					0,
-					uint64(time.Now().Unix()),
-					[]dao.Tx{tx},
-				)
-				var err error
-				txAddRes.Hash, err = state.AddBlock(block)
-				if err != nil {
-					_, _ = fmt.Fprintln(os.Stderr, err)
-					return
-				}
-			} else {
-				// Send the request to the server
-				url := fmt.Sprintf("http://%s%s", thisPeerNode.TcpAddress(), node.EndpointTxAdd)
-				jsonTx, err := json.Marshal(tx)
-				if err != nil {
-					_, _ = fmt.Fprintln(os.Stderr, err)
+				if miner == "" {
+					_, _ = fmt.Fprintf(os.Stderr, "--%s is needed to mine the TX when no node is running\n", flagMiner)
 					return
 				}
-				req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonTx))
+				minerAccount, err := dao.ParseAccount(miner)
 				if err != nil {
 					_, _ = fmt.Fprintln(os.Stderr, err)
 					return
 				}
-				req.Header.Set("Content-Type", "application/json")
-
-				client := &http.Client{}
-				resp, err := client.Do(req) // Send the post and hopefully get a response
+				pendingBlock := node.NewPendingBlock(state, minerAccount, []dao.SignedTx{tx})
+				block, err := node.Mine(context.Background(), pendingBlock)
 				if err != nil {
 					_, _ = fmt.Fprintln(os.Stderr, err)
 					return
 				}
-				defer resp.Body.Close()
-				err = json.NewDecoder(resp.Body).Decode(&txAddRes)
+				hash, err := state.AddBlock(block)
 				if err != nil {
 					_, _ = fmt.Fprintln(os.Stderr, err)
 					return
 				}
+				fmt.Printf("TX %s successfully added to the ledger. %v\n", txHash.Hex(), hash.Hex())
+				return
+			}
 
-				//fmt.Println("response Status:", resp.Status)
-				//fmt.Println("response Headers:", resp.Header)
-				//body, _ := ioutil.ReadAll(resp.Body)
-				//err = json.Unmarshal(body, &txAddRes)
-				//fmt.Println("response Body:", string(body))
-				//if err != nil {
-				//	_, _ = fmt.Fprintln(os.Stderr, err)
-				//	return
-				//}
-
+			// Send the request to the server, it will be mined with the rest of the mempool
+			var txAddRes node.TxAddRes
+			err = postToNode(node.EndpointTxAdd, tx, &txAddRes)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
 			}
 
-			fmt.Printf("TX successfully added to the ledger. %v\n", txAddRes.Hash.Hex())
+			fmt.Printf("TX %s successfully added to the mempool of %s\n", txAddRes.Hash.Hex(), thisPeerNode.TcpAddress())
 		},
 	}
 
-	cmd.Flags().String(flagFrom, "", "From what account to send tokens")
+	cmd.Flags().String(flagFrom, "", "From what account address to send tokens, its key must be in the keystore")
 	_ = cmd.MarkFlagRequired(flagFrom)
 
-	cmd.Flags().String(flagTo, "", "To what account to send tokens")
+	cmd.Flags().String(flagTo, "", "To what account address to send tokens")
 	_ = cmd.MarkFlagRequired(flagTo)
 
 	cmd.Flags().Uint(flagValue, 0, "How many tokens to send")
 	_ = cmd.MarkFlagRequired(flagValue)
 
-	_ = cmd.Flags().String(flagData, "", "e.g.: 'reward', 'services',' vodka' ...")
+	_ = cmd.Flags().Uint(flagFee, dao.DefaultMinFee, "How many tokens to pay the miner, the highest fees are mined first")
+
+	_ = cmd.Flags().String(flagData, "", "e.g.: 'services',' vodka' ...")
+
+	_ = cmd.Flags().String(flagMiner, "", "Account address rewarded for mining the TX when no node is running")
+
+	return cmd
+}
+
+func txShowCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "show <tx hash>",
+		Short: "Shows a TX and the block it was mined in, or that it's pending.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			txHash := dao.Hash{}
+			err := txHash.UnmarshalText([]byte(args[0]))
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+
+			var txRes node.TxRes
+			if conn == nil {
+				txRes, err = node.FindTx(txHash, state)
+			} else {
+				err = getFromNode(node.EndpointTx+txHash.Hex(), &txRes)
+			}
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+
+			txJson, err := json.MarshalIndent(txRes.Tx, "", "  ")
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			fmt.Println(string(txJson))
+
+			if txRes.Status == node.TxStatusPending {
+				fmt.Printf("TX %s is pending in the mempool\n", txHash.Hex())
+				return
+			}
+			fmt.Printf("TX %s is in block %d '%s' with %d confirmations\n", txHash.Hex(), txRes.BlockNumber, txRes.BlockHash.Hex(), txRes.Confirmations)
+		},
+	}
+
+	return cmd
+}
+
+func txProofCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "proof <tx hash>",
+		Short: "Proves a TX is in a block using only the block header.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			txHash := dao.Hash{}
+			err := txHash.UnmarshalText([]byte(args[0]))
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+
+			var txProofRes node.TxProofRes
+			if conn == nil {
+				txProofRes, err = node.TxProof(txHash, state)
+			} else {
+				err = getFromNode(fmt.Sprintf("%s?%s=%s", node.EndpointTxProof, node.EndpointTxProofQueryKeyTx, txHash.Hex()), &txProofRes)
+			}
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+
+			proofJson, err := json.MarshalIndent(txProofRes, "", "  ")
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			fmt.Println(string(proofJson))
+
+			// Check the proof using nothing but the header
+			headerHash := txProofRes.Header.Hash()
+			if headerHash != txProofRes.BlockHash {
+				_, _ = fmt.Fprintf(os.Stderr, "The header hashes to '%s' not block '%s'\n", headerHash.Hex(), txProofRes.BlockHash.Hex())
+				return
+			}
+			verified := dao.VerifyMerkleProof(txProofRes.Tx, txProofRes.Proof, txProofRes.Header.TxRoot)
+			if txProofRes.Tx.Hash() != txHash || !verified {
+				_, _ = fmt.Fprintf(os.Stderr, "The proof doesn't lead from TX '%s' to the transaction root '%s'\n", txHash.Hex(), txProofRes.Header.TxRoot.Hex())
+				return
+			}
+
+			fmt.Printf("TX %s is verified to be in block %d '%s'\n", txHash.Hex(), txProofRes.Header.BlockNumber, txProofRes.BlockHash.Hex())
+		},
+	}
 
 	return cmd
 }
+
+// The nonce the next TX from the account needs, including any TXs already in the mempool
+func getNextNonce(account dao.Account) (uint64, error) {
+	if conn == nil {
+		return state.NextNonce(account), nil
+	}
+
+	var res node.AccountNonceRes
+	err := getFromNode(fmt.Sprintf("%s?%s=%s", node.EndpointAccountNonce, node.EndpointAccountNonceQueryKeyAccount, account), &res)
+	return res.Nonce, err
+}
@@ -0,0 +1,181 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"simpleblockchain/dao"
+	"simpleblockchain/wallet"
+)
+
+func WalletCmd() *cobra.Command {
+	var walletCmd = &cobra.Command{
+		Use:   "wallet",
+		Short: "Manage the accounts in the keystore (new, list, import, export, change-passphrase...).",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return IncorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+
+	walletCmd.AddCommand(walletNewCmd())
+	walletCmd.AddCommand(walletListCmd())
+	walletCmd.AddCommand(walletImportCmd())
+	walletCmd.AddCommand(walletExportCmd())
+	walletCmd.AddCommand(walletChangePassphraseCmd())
+
+	return walletCmd
+}
+
+func walletNewCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "new",
+		Short: "Creates a new account with a new key pair.",
+		Run: func(cmd *cobra.Command, args []string) {
+			key, err := wallet.NewKey()
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			storeKey(key)
+
+			fmt.Printf("New account %s\n", key.Account)
+			fmt.Printf("The key is in the keystore %s\n", dao.GetKeystoreDirPath(dataDir))
+		},
+	}
+
+	return cmd
+}
+
+func walletListCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "list",
+		Short: "Lists the accounts in the keystore.",
+		Run: func(cmd *cobra.Command, args []string) {
+			accounts, err := wallet.ListAccounts(dataDir)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			for _, account := range accounts {
+				fmt.Println(account)
+			}
+		},
+	}
+
+	return cmd
+}
+
+func walletImportCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "import",
+		Short: "Adds an exported private key to the keystore.",
+		Run: func(cmd *cobra.Command, args []string) {
+			privateKey, err := readPassphrase("Private key (hex): ")
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			key, err := wallet.NewKeyFromHex(privateKey)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			storeKey(key)
+
+			fmt.Printf("Imported account %s\n", key.Account)
+		},
+	}
+
+	return cmd
+}
+
+func walletExportCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "export <account>",
+		Short: "Prints the unencrypted private key of an account, keep it secret.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			key := loadKey(args[0])
+
+			fmt.Println(key.Hex())
+		},
+	}
+
+	return cmd
+}
+
+func walletChangePassphraseCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "change-passphrase <account>",
+		Short: "Encrypts the key of an account with a new passphrase, an unencrypted older key has an empty passphrase.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			account, passphrase := readAccountPassphrase(args[0])
+
+			newPassphrase, err := readNewPassphrase(fmt.Sprintf("New passphrase for %s: ", account))
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			err = wallet.ChangePassphrase(dataDir, account, passphrase, newPassphrase)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Changed the passphrase of account %s\n", account)
+		},
+	}
+
+	return cmd
+}
+
+// Ask for a new passphrase and encrypt the key into the keystore with it
+func storeKey(key wallet.Key) {
+	passphrase, err := readNewPassphrase(fmt.Sprintf("New passphrase for %s: ", key.Account))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = wallet.StoreKey(dataDir, key, passphrase)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Ask for the passphrase of the account and decrypt its key from the keystore
+func loadKey(address string) wallet.Key {
+	account, passphrase := readAccountPassphrase(address)
+
+	key, err := wallet.LoadKey(dataDir, account, passphrase)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	return key
+}
+
+func readAccountPassphrase(address string) (dao.Account, string) {
+	account, err := dao.ParseAccount(address)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", account))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	return account, passphrase
+}
@@ -1,7 +1,59 @@
 package dao
 
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Every address starts with the prefix followed by the hex of the
+// public key hash and a checksum of the public key hash
+const AddressPrefix = "tbb"
+const addressHashLen = 20
+const addressChecksumLen = 4
+
 type Account string
 
 func NewAccount(value string) Account {
 	return Account(value)
 }
+
+// NewAccountFromPublicKey is the address of the account owning the key
+func NewAccountFromPublicKey(publicKey ed25519.PublicKey) Account {
+	publicKeyHash := sha256.Sum256(publicKey)
+	payload := publicKeyHash[:addressHashLen]
+
+	return Account(AddressPrefix + hex.EncodeToString(append(payload, addressChecksum(payload)...)))
+}
+
+// ParseAccount checks the value is a well formed address
+// A mistyped address fails the checksum
+func ParseAccount(value string) (Account, error) {
+	if !strings.HasPrefix(value, AddressPrefix) {
+		return "", fmt.Errorf("address '%s' must start with '%s'", value, AddressPrefix)
+	}
+
+	raw, err := hex.DecodeString(strings.TrimPrefix(value, AddressPrefix))
+	if err != nil {
+		return "", fmt.Errorf("address '%s' is not hex: %w", value, err)
+	}
+	if len(raw) != addressHashLen+addressChecksumLen {
+		return "", fmt.Errorf("address '%s' must be %d characters long", value, len(AddressPrefix)+2*(addressHashLen+addressChecksumLen))
+	}
+
+	payload := raw[:addressHashLen]
+	if !bytes.Equal(raw[addressHashLen:], addressChecksum(payload)) {
+		return "", fmt.Errorf("address '%s' has an invalid checksum, check it for typos", value)
+	}
+
+	return Account(strings.ToLower(value)), nil
+}
+
+func addressChecksum(payload []byte) []byte {
+	first := sha256.Sum256(append([]byte(AddressPrefix), payload...))
+	second := sha256.Sum256(first[:])
+	return second[:addressChecksumLen]
+}
@@ -0,0 +1,63 @@
+package dao
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseAccount(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := NewAccountFromPublicKey(publicKey)
+
+	parsed, err := ParseAccount(string(account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != account {
+		t.Errorf("got %s; want %s", parsed, account)
+	}
+
+	if parsed, err := ParseAccount(strings.ToUpper(string(account[:3])) + string(account[3:])); err == nil {
+		t.Errorf("got %s; want an error for the upper case prefix", parsed)
+	}
+	if parsed, err := ParseAccount(AddressPrefix + strings.ToUpper(string(account[3:]))); err != nil || parsed != account {
+		t.Errorf("got %s, %v; want %s", parsed, err, account)
+	}
+}
+
+func TestParseAccountCatchesTypos(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := string(NewAccountFromPublicKey(publicKey))
+
+	testCases := map[string]string{
+		"a name":             "babayaga",
+		"a character short":  account[:len(account)-1],
+		"an extra character": account + "0",
+		"not hex":            account[:10] + "z" + account[11:],
+	}
+
+	// Change every character in turn
+	for i := len(AddressPrefix); i < len(account); i++ {
+		replacement := "0"
+		if account[i] == '0' {
+			replacement = "1"
+		}
+		testCases[fmt.Sprintf("typo at %d", i)] = account[:i] + replacement + account[i+1:]
+	}
+
+	for name, value := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseAccount(value); err == nil {
+				t.Errorf("'%s' should not be a valid address", value)
+			}
+		})
+	}
+}
@@ -1,14 +1,12 @@
 package dao
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"reflect"
+	"math/big"
+	"math/bits"
 )
 
 type Hash [32]byte
@@ -17,7 +15,11 @@ func (h Hash) MarshalText() ([]byte, error) {
 	return []byte(hex.EncodeToString(h[:])), nil
 }
 
+// An empty text is the empty hash, otherwise it must be the full hash in hex
 func (h *Hash) UnmarshalText(data []byte) error {
+	if len(data) != 0 && len(data) != hex.EncodedLen(len(h)) {
+		return fmt.Errorf("a hash must be %d hex characters not %d", hex.EncodedLen(len(h)), len(data))
+	}
 	_, err := hex.Decode(h[:], data)
 	return err
 }
@@ -33,15 +35,18 @@ func (h Hash) IsEmpty() bool {
 
 type Block struct {
 	Header BlockHeader `json:"header"`  // metadata (parent block hash + time)
-	TXs    []Tx        `json:"payload"` // new transactions only (payload)
+	TXs    []SignedTx  `json:"payload"` // new transactions only (payload)
 }
 
 // This is the header of the block
 type BlockHeader struct {
-	Parent      Hash   `json:"parent"` // The hash of the previous block
-	BlockNumber uint64 `json:"number"` // A sequence number for the block, "block height"
-	Nonce       uint32 `json:"nonce"`  // Adding a bit of randomness to the block hash
-	Time        uint64 `json:"time"`   // The time this block was completed
+	Parent      Hash    `json:"parent"`     // The hash of the previous block
+	BlockNumber uint64  `json:"number"`     // A sequence number for the block, "block height"
+	Nonce       uint32  `json:"nonce"`      // Adding a bit of randomness to the block hash
+	Time        uint64  `json:"time"`       // The time this block was completed
+	Difficulty  uint32  `json:"difficulty"` // The number of leading zero bits the block hash must have
+	Miner       Account `json:"miner"`      // The account rewarded for mining the block
+	TxRoot      Hash    `json:"tx_root"`    // The Merkle root of the transactions
 }
 
 // This is what's written to the filesystem
@@ -54,66 +59,131 @@ type BlockFS struct {
 
 // A block is made up of a header and transactions
 // A block header has the time, sequence number and the hash of the previous block
-func NewBlock(parent Hash, blockNumber uint64, nonce uint32, time uint64, txs []Tx) Block {
-	return Block{BlockHeader{parent, blockNumber, nonce, time}, txs}
+// The header includes the Merkle root of the transactions
+func NewBlock(parent Hash, blockNumber uint64, nonce uint32, time uint64, difficulty uint32, miner Account, txs []SignedTx) Block {
+	return Block{BlockHeader{parent, blockNumber, nonce, time, difficulty, miner, MerkleRoot(txs)}, txs}
 }
 
 // This generates a hash for a block
-func (b Block) Hash() (Hash, error) {
-	blockJson, err := json.Marshal(b)
-	if err != nil {
-		return Hash{}, err
-	}
-	return sha256.Sum256(blockJson), nil
+// Only the header is hashed, the transactions are included through the Merkle root
+func (b Block) Hash() Hash {
+	return b.Header.Hash()
 }
 
-func IsBlockHashValid(hash Hash) bool {
-	// 184648311	         6.36 ns/op
-	return bytes.Equal(hash[:2], []byte{0, 0})
-	// 8908318	       118 ns/op
-	//return hash.Hex()[0:4] == "0000"
-	// 4187757	       252 ns/op
-	//return fmt.Sprintf("%x", hash[0]) == "0" &&
-	//	fmt.Sprintf("%x", hash[1]) == "0" &&
-	//	fmt.Sprintf("%x", hash[2]) == "0" &&
-	//	fmt.Sprintf("%x", hash[3]) != "0"
+// The hash of the canonical encoding of the header, see encoding.go
+func (h BlockHeader) Hash() Hash {
+	return prefixedHash(headerHashPrefix, h.Encode())
+}
+
+// A hash is valid when it starts with at least difficulty zero bits
+func IsBlockHashValid(hash Hash, difficulty uint32) bool {
+	return leadingZeroBits(hash) >= difficulty
+}
+
+// BlockWork is the number of hashes it takes on average to mine a block
+// Every bit of difficulty doubles the work
+func BlockWork(difficulty uint32) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+func leadingZeroBits(hash Hash) uint32 {
+	zeros := uint32(0)
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + uint32(bits.LeadingZeros8(b))
+		}
+		zeros += 8
+	}
+	return zeros
 }
 
+// ErrBlockNotFound is returned when a block isn't in the chain
+var ErrBlockNotFound = errors.New("block not found")
+
+// ErrTxNotFound is returned when a transaction isn't in any block of the chain
+var ErrTxNotFound = errors.New("transaction not found")
+
 // This returns all the blocks after a specific hash
+// An empty hash returns every block in the chain
 func GetBlocksAfter(blockHash Hash, s *State) ([]Block, error) {
-	f, err := os.OpenFile(getBlocksDbFilePath(s.dataDir), os.O_RDONLY, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("Could not open the local blocks file: %w", err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from := uint64(0)
+	if !blockHash.IsEmpty() {
+		blockFs, err := s.blocks.GetByHash(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		from = blockFs.Value.Header.BlockNumber + 1
 	}
 
 	blocks := make([]Block, 0)
-	shouldStartCollecting := false
+	err := s.blocks.Iterate(from, func(blockFs BlockFS) error {
+		blocks = append(blocks, blockFs.Value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
 
-	if reflect.DeepEqual(blockHash, Hash{}) {
-		shouldStartCollecting = true
+// This returns the block at a specific height
+func GetBlockByHeight(height uint64, s *State) (BlockFS, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.blocks.GetByHeight(height)
+}
+
+// This returns the block with a specific hash
+func GetBlockByHash(blockHash Hash, s *State) (BlockFS, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.blocks.GetByHash(blockHash)
+}
+
+// This finds the block a transaction is in and where it is in the block
+func GetBlockWithTx(txHash Hash, s *State) (BlockFS, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.getBlockWithTx(txHash)
+}
+
+// This finds the block a transaction is in, where it is in the block and how many blocks
+// have been mined from its block onwards, all read from the chain as it is at one moment
+func GetBlockWithTxConfirmations(txHash Hash, s *State) (BlockFS, int, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blockFs, index, err := s.getBlockWithTx(txHash)
+	if err != nil {
+		return BlockFS{}, 0, 0, err
 	}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			return nil, fmt.Errorf("Cannot read line from block: %w", err)
-		}
+	confirmations := uint64(0)
+	latest := s.latestBlock.Header.BlockNumber
+	if s.hasGenesisBlock && latest >= blockFs.Value.Header.BlockNumber {
+		confirmations = latest - blockFs.Value.Header.BlockNumber + 1
+	}
 
-		// Read next json message within the block
-		blockFsJson := scanner.Bytes()
-		var blockFs BlockFS
-		err = json.Unmarshal(blockFsJson, &blockFs)
-		if err != nil {
-			return nil, fmt.Errorf("Cannot interpret json %v: %w", blockFsJson, err)
-		}
+	return blockFs, index, confirmations, nil
+}
 
-		// Are we starting to collect blocks?
-		if shouldStartCollecting {
-			blocks = append(blocks, blockFs.Value)
-		} else if blockHash == blockFs.Key { // Should we start collecting blocks?
-			shouldStartCollecting = true
-		}
+func (s *State) getBlockWithTx(txHash Hash) (BlockFS, int, error) {
+	position, ok := s.txs.position(txHash)
+	if !ok {
+		return BlockFS{}, 0, fmt.Errorf("%w: '%s'", ErrTxNotFound, txHash.Hex())
 	}
 
-	return blocks, nil
+	blockFs, err := s.blocks.GetByHeight(position.height)
+	if err != nil {
+		return BlockFS{}, 0, err
+	}
+
+	return blockFs, int(position.index), nil
 }
@@ -0,0 +1,239 @@
+package dao
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The canonical binary encoding of headers and transactions
+//
+// Headers and transactions are hashed and signed in this encoding, so every implementation
+// gets the same hashes. Json is only how they're shown by the API and kept in the json store.
+//
+// Integers are big-endian and fixed width with a uint written as 64 bits. A hash is its
+// 32 bytes. Strings and byte slices are their length as a uint32 followed by their bytes,
+// and a list is its length as a uint32 followed by each item in turn. An account is the
+// string of its address. The fields are written in this order
+//
+//	BlockHeader  parent hash, number uint64, nonce uint32, time uint64,
+//	             difficulty uint32, miner account, tx_root hash
+//	Tx           from account, to account, nonce uint64, value uint, fee uint, data string
+//	SignedTx     the Tx, public_key bytes, signature bytes
+//
+// The hash is the SHA-256 of a prefix byte followed by the encoding, the prefix keeps
+// each kind of hash apart from the others and from the Merkle tree hashes.
+//
+// The segmented block store writes a block as its hash, its header, and then the
+// list of its signed transactions.
+
+const headerHashPrefix = 0x02
+const txHashPrefix = 0x03
+const signedTxHashPrefix = 0x04
+const genesisHashPrefix = 0x05
+
+var errEncodingCutShort = errors.New("the encoding is cut short")
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) hash(h Hash) {
+	e.buf = append(e.buf, h[:]...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.bytes([]byte(s))
+}
+
+// The decoder remembers the first error so the fields can be read without checking each one
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.buf) {
+		d.err = errEncodingCutShort
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) hash() Hash {
+	var h Hash
+	copy(h[:], d.next(len(h)))
+	return h
+}
+
+// An empty byte slice is decoded as nil, as it is from json
+func (d *decoder) bytes() []byte {
+	length := d.uint32()
+	if length == 0 {
+		return nil
+	}
+	b := d.next(int(length))
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// Encode the header in its canonical encoding
+func (h BlockHeader) Encode() []byte {
+	e := &encoder{}
+	e.header(h)
+	return e.buf
+}
+
+// Encode the transaction in its canonical encoding
+func (t Tx) Encode() []byte {
+	e := &encoder{}
+	e.tx(t)
+	return e.buf
+}
+
+// Encode the signed transaction in its canonical encoding
+func (t SignedTx) Encode() []byte {
+	e := &encoder{}
+	e.signedTx(t)
+	return e.buf
+}
+
+func (e *encoder) header(h BlockHeader) {
+	e.hash(h.Parent)
+	e.uint64(h.BlockNumber)
+	e.uint32(h.Nonce)
+	e.uint64(h.Time)
+	e.uint32(h.Difficulty)
+	e.string(string(h.Miner))
+	e.hash(h.TxRoot)
+}
+
+func (e *encoder) tx(t Tx) {
+	e.string(string(t.From))
+	e.string(string(t.To))
+	e.uint64(t.Nonce)
+	e.uint64(uint64(t.Value))
+	e.uint64(uint64(t.Fee))
+	e.string(t.Data)
+}
+
+func (e *encoder) signedTx(t SignedTx) {
+	e.tx(t.Tx)
+	e.bytes(t.PublicKey)
+	e.bytes(t.Sig)
+}
+
+func (d *decoder) header() BlockHeader {
+	var h BlockHeader
+	h.Parent = d.hash()
+	h.BlockNumber = d.uint64()
+	h.Nonce = d.uint32()
+	h.Time = d.uint64()
+	h.Difficulty = d.uint32()
+	h.Miner = Account(d.string())
+	h.TxRoot = d.hash()
+	return h
+}
+
+func (d *decoder) signedTx() SignedTx {
+	var t SignedTx
+	t.From = Account(d.string())
+	t.To = Account(d.string())
+	t.Nonce = d.uint64()
+	t.Value = uint(d.uint64())
+	t.Fee = uint(d.uint64())
+	t.Data = d.string()
+	t.PublicKey = d.bytes()
+	t.Sig = d.bytes()
+	return t
+}
+
+// The SHA-256 of the prefix followed by the encoding
+func prefixedHash(prefix byte, encoding []byte) Hash {
+	return sha256.Sum256(append([]byte{prefix}, encoding...))
+}
+
+func encodeBlockFs(blockFs BlockFS) []byte {
+	e := &encoder{}
+	e.hash(blockFs.Key)
+	e.header(blockFs.Value.Header)
+
+	e.uint32(uint32(len(blockFs.Value.TXs)))
+	for _, tx := range blockFs.Value.TXs {
+		e.signedTx(tx)
+	}
+
+	return e.buf
+}
+
+func decodeBlockFs(b []byte) (BlockFS, error) {
+	d := &decoder{buf: b}
+
+	var blockFs BlockFS
+	blockFs.Key = d.hash()
+	blockFs.Value.Header = d.header()
+
+	count := d.uint32()
+	// Each transaction is at least 44 bytes so a corrupt count can't allocate much
+	if d.err == nil && uint64(count) > uint64(len(d.buf)/44) {
+		return BlockFS{}, fmt.Errorf("Cannot decode block: %d transactions is more than the block holds", count)
+	}
+	blockFs.Value.TXs = make([]SignedTx, 0, count)
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		blockFs.Value.TXs = append(blockFs.Value.TXs, d.signedTx())
+	}
+
+	if d.err != nil {
+		return BlockFS{}, fmt.Errorf("Cannot decode block: %w", d.err)
+	}
+	if len(d.buf) > 0 {
+		return BlockFS{}, fmt.Errorf("Cannot decode block: %d bytes are left over", len(d.buf))
+	}
+
+	return blockFs, nil
+}
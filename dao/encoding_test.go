@@ -0,0 +1,96 @@
+package dao
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+)
+
+// These vectors pin the canonical encoding, a change to any of them breaks every existing chain
+func TestCanonicalEncodingVectors(t *testing.T) {
+	var parent, txRoot Hash
+	copy(parent[:], bytes.Repeat([]byte{0x11}, len(parent)))
+	copy(txRoot[:], bytes.Repeat([]byte{0x22}, len(txRoot)))
+	header := BlockHeader{parent, 1, 2, 1600000000, 16, "andrej", txRoot}
+
+	tx := NewTx("andrej", "babayaga", 7, 100, 1, "rent")
+
+	privateKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x01}, ed25519.SeedSize))
+	from := NewAccountFromPublicKey(privateKey.Public().(ed25519.PublicKey))
+	signedTx := NewSignedTx(NewTx(from, "babayaga", 7, 100, 1, "rent"), privateKey)
+
+	testCases := []struct {
+		name     string
+		encoding []byte
+		hash     func() Hash
+		want     string
+		wantHash string
+	}{
+		{
+			"header",
+			header.Encode(),
+			header.Hash,
+			"1111111111111111111111111111111111111111111111111111111111111111" + // parent
+				"0000000000000001" + // number
+				"00000002" + // nonce
+				"000000005f5e1000" + // time
+				"00000010" + // difficulty
+				"00000006616e6472656a" + // miner
+				"2222222222222222222222222222222222222222222222222222222222222222", // tx_root
+			"7e893d9287b3f764e83b793632ddfdc9a9abcebb70d98ba57a10f2aa3652f7a0",
+		},
+		{
+			"tx",
+			tx.Encode(),
+			tx.Hash,
+			"00000006616e6472656a" + // from
+				"000000086261626179616761" + // to
+				"0000000000000007" + // nonce
+				"0000000000000064" + // value
+				"0000000000000001" + // fee
+				"0000000472656e74", // data
+			"de9b411c062cbbd8a31e3e383d61d0bf02b31cabc73b65100e7a3e91f3a219f3",
+		},
+		{
+			"signed tx",
+			signedTx.Encode(),
+			signedTx.Hash,
+			hex.EncodeToString(signedTx.Tx.Encode()) +
+				"00000020" + hex.EncodeToString(signedTx.PublicKey) +
+				"00000040" + hex.EncodeToString(signedTx.Sig),
+			"575215510b8a80e20eddfe790afce881a27e7d2ad45538ea8f17f54c7b509f3f",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := hex.EncodeToString(tc.encoding); got != tc.want {
+				t.Errorf("got encoding %s; want %s", got, tc.want)
+			}
+			if hash := tc.hash(); hash.Hex() != tc.wantHash {
+				t.Errorf("got hash %s; want %s", hash.Hex(), tc.wantHash)
+			}
+		})
+	}
+}
+
+func TestDecodeBlockFsRejectsBadEncodings(t *testing.T) {
+	blockFs := newTestBlocks(t, 2)[1]
+	encoded := encodeBlockFs(blockFs)
+
+	testCases := []struct {
+		name    string
+		encoded []byte
+	}{
+		{"cut short", encoded[:len(encoded)-1]},
+		{"left over bytes", append(append([]byte{}, encoded...), 0)},
+		{"too many transactions", append(append(append([]byte{}, encoded[:len(blockFs.Key)]...), blockFs.Value.Header.Encode()...), 0xff, 0xff, 0xff, 0xff)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := decodeBlockFs(tc.encoded); err == nil {
+				t.Error("decoded a bad encoding")
+			}
+		})
+	}
+}
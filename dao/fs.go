@@ -4,30 +4,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 )
 
+// The genesis file isn't created here, 'tbb genesis init' writes it so it pays real accounts
 func initDataDirIfNotExists(dataDir string) error {
 	// Ensure the database directory exist
 	if err := os.MkdirAll(getDatabaseDirPath(dataDir), os.ModePerm); err != nil {
 		return fmt.Errorf("Error creating data directory: %w", err)
 	}
 
-	// Ensure the genesis file exists
-	if !fileExist(getGenesisJsonFilePath(dataDir)) {
-		if err := writeGenesisToDisk(getGenesisJsonFilePath(dataDir)); err != nil {
-			return fmt.Errorf("Could not create genesis file: %w", err)
-		}
-	}
-
-	// Ensure the Block file exists
-	if !fileExist(getBlocksDbFilePath(dataDir)) {
-		if err := writeEmptyBlocksDbToDisk(getBlocksDbFilePath(dataDir)); err != nil {
-			return fmt.Errorf("Could not create empty block file: %w", err)
-		}
-	}
-
 	return nil
 }
 
@@ -35,18 +21,43 @@ func getDatabaseDirPath(dataDir string) string {
 	return filepath.Join(dataDir, "db")
 }
 
-func getGenesisJsonFilePath(dataDir string) string {
+func GetGenesisJsonFilePath(dataDir string) string {
 	return filepath.Join(getDatabaseDirPath(dataDir), "genesis.json")
 }
 
+// The lock file is in the data dir rather than the database dir as the lock covers the keystore too
+func getLockFilePath(dataDir string) string {
+	return filepath.Join(dataDir, "tbb.lock")
+}
+
 func getBlocksDbFilePath(dataDir string) string {
 	return filepath.Join(getDatabaseDirPath(dataDir), "block.db")
 }
 
+func getTxIndexFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "tx.idx")
+}
+
+func getBlockIndexFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "block.idx")
+}
+
+func getSnapshotsDirPath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "snapshots")
+}
+
+func getSegmentsDirPath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "segments")
+}
+
 func GetThisPeerJsonFilePath(dataDir string) string {
 	return filepath.Join(dataDir, "thispeernode.json")
 }
 
+func GetKeystoreDirPath(dataDir string) string {
+	return filepath.Join(dataDir, "keystore")
+}
+
 func fileExist(filePath string) bool {
 	//fmt.Print(filePath, " :")
 	_, err := os.Stat(filePath)
@@ -74,19 +85,31 @@ func writeEmptyBlocksDbToDisk(path string) error {
 	return ioutil.WriteFile(path, []byte(""), os.ModePerm)
 }
 
-// Read text file
-func readTextFile(dir string, filename string) ([]byte, error) {
-	// get current working directory or error
-	cwd, err := os.Getwd()
+// Write the file alongside the old one and then rename it over the old one, so a crash
+// leaves either the old file or the new one and never half of the new one
+// The new file is flushed before the rename and the directory after it. With SyncNever that's
+// left to the OS, so a power cut can still leave the new file empty or cut short.
+func writeFileAtomically(path string, content []byte, policy SyncPolicy) error {
+	tmpFilePath := path + ".tmp"
+	f, err := os.OpenFile(tmpFilePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = syncFile(f, policy)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return nil, err
+		os.Remove(tmpFilePath)
+		return err
 	}
 
-	//Determine the filepath
-	textFile := path.Join(cwd, dir, filename)
-	res, err := ioutil.ReadFile(textFile)
+	err = os.Rename(tmpFilePath, path)
 	if err != nil {
-		return nil, fmt.Errorf("Error loading text file %s:%w", textFile, err)
+		return err
 	}
-	return res, nil
+	return syncDir(filepath.Dir(path), policy)
 }
@@ -5,59 +5,234 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
+	"regexp"
+	"simpleblockchain/static"
+	"sort"
 	"text/template"
 	"time"
 )
 
-type genesis struct {
-	Balances map[Account]uint `json:"balances"`
+// Chain parameters used when the genesis file doesn't specify them
+const DefaultDifficulty = 16
+const DefaultRetargetInterval = 10
+const DefaultBlockTime = 15
+const DefaultBlockReward = 100
+const DefaultMaxTimeDrift = 2 * 60 * 60
+
+// The minimum fee written into new genesis files
+// Older genesis files without a minimum fee keep their transactions free
+const DefaultMinFee = 1
+
+var chainIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Genesis is the start of the chain, the first balances and the chain parameters
+type Genesis struct {
+	GenesisTime      string           `json:"genesis_time"`
+	ChainID          string           `json:"chain_id"` // Names the chain, letters, digits, '-', '_' and '.'
+	Balances         map[Account]uint `json:"balances"`
+	Difficulty       uint32           `json:"difficulty"`        // The difficulty of the first blocks
+	RetargetInterval uint64           `json:"retarget_interval"` // How many blocks between difficulty changes
+	BlockTime        uint64           `json:"block_time"`        // The target number of seconds between blocks
+	BlockReward      uint             `json:"block_reward"`      // The most a miner can reward themselves for a block
+	MaxTimeDrift     uint64           `json:"max_time_drift"`    // How many seconds a block can be ahead of a node's clock
+	MinFee           uint             `json:"min_fee"`           // The least a transaction must pay the miner
 }
 
-func loadGenesis(path string) (genesis, error) {
+// NewGenesis is a genesis starting now with the default chain parameters
+func NewGenesis(chainID string, balances Balances) Genesis {
+	return Genesis{
+		GenesisTime:      time.Now().Format(time.RFC3339Nano),
+		ChainID:          chainID,
+		Balances:         balances,
+		Difficulty:       DefaultDifficulty,
+		RetargetInterval: DefaultRetargetInterval,
+		BlockTime:        DefaultBlockTime,
+		BlockReward:      DefaultBlockReward,
+		MaxTimeDrift:     DefaultMaxTimeDrift,
+		MinFee:           DefaultMinFee,
+	}
+}
+
+// Hash identifies the chain, block 0 has it as its parent so the blocks only belong to one genesis
+//
+// It's the hash of the canonical encoding of the chain id, the genesis time, the chain
+// parameters in the order of the genesis fields and then the balances in account order.
+func (g Genesis) Hash() Hash {
+	e := &encoder{}
+	e.string(g.ChainID)
+	e.string(g.GenesisTime)
+	e.uint32(g.Difficulty)
+	e.uint64(g.RetargetInterval)
+	e.uint64(g.BlockTime)
+	e.uint64(uint64(g.BlockReward))
+	e.uint64(g.MaxTimeDrift)
+	e.uint64(uint64(g.MinFee))
+
+	accounts := make([]Account, 0, len(g.Balances))
+	for account := range g.Balances {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i] < accounts[j] })
+	e.uint32(uint32(len(accounts)))
+	for _, account := range accounts {
+		e.string(string(account))
+		e.uint64(uint64(g.Balances[account]))
+	}
+
+	return prefixedHash(genesisHashPrefix, e.buf)
+}
+
+// The chain can't run with a parameter outside of these
+func (g Genesis) checkParameters() error {
+	if g.Difficulty > 255 {
+		return fmt.Errorf("The difficulty %d can't be more than 255 bits", g.Difficulty)
+	}
+	if g.RetargetInterval < 2 {
+		return fmt.Errorf("The retarget interval of %d blocks must be at least 2 blocks", g.RetargetInterval)
+	}
+	if g.BlockTime == 0 {
+		return fmt.Errorf("The block time must be at least 1 second")
+	}
+	return nil
+}
+
+// Older genesis files don't have the chain parameters, those left out are the defaults
+// A parameter that is there is kept as it is, even 0, a difficulty of 0 takes any hash.
+// Every balance must belong to an address, as nobody could ever sign for anything else.
+func loadGenesis(path string) (Genesis, error) {
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		return genesis{}, err
+		return Genesis{}, err
 	}
 
-	var loadedGenesis genesis
+	loadedGenesis := Genesis{
+		Difficulty:       DefaultDifficulty,
+		RetargetInterval: DefaultRetargetInterval,
+		BlockTime:        DefaultBlockTime,
+		BlockReward:      DefaultBlockReward,
+		MaxTimeDrift:     DefaultMaxTimeDrift,
+	}
 	err = json.Unmarshal(content, &loadedGenesis)
 	if err != nil {
-		return genesis{}, err
+		return Genesis{}, err
+	}
+	for account := range loadedGenesis.Balances {
+		if _, err := ParseAccount(string(account)); err != nil {
+			return Genesis{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	err = loadedGenesis.checkParameters()
+	if err != nil {
+		return Genesis{}, fmt.Errorf("%s: %w", path, err)
 	}
 
 	return loadedGenesis, nil
 }
 
-func writeGenesisToDisk(genesisFile string) error {
-	// get current working directory or error
-	cwd, err := os.Getwd()
+// WriteGenesis writes the genesis file that starts a new chain in the data dir
+// It returns the genesis hash. The chain parameters are written as they are or refused, never
+// changed. A genesis can't be replaced once there are blocks.
+func WriteGenesis(dataDir string, gen Genesis) (Hash, error) {
+	if !chainIDPattern.MatchString(gen.ChainID) {
+		return Hash{}, fmt.Errorf("The chain id '%s' must be letters, digits, '-', '_' or '.'", gen.ChainID)
+	}
+	for account := range gen.Balances {
+		if _, err := ParseAccount(string(account)); err != nil {
+			return Hash{}, err
+		}
+	}
+	if err := gen.checkParameters(); err != nil {
+		return Hash{}, err
+	}
+
+	if err := os.MkdirAll(getDatabaseDirPath(dataDir), os.ModePerm); err != nil {
+		return Hash{}, fmt.Errorf("Error creating data directory: %w", err)
+	}
+	lock, err := lockDataDir(dataDir, false)
+	if err != nil {
+		return Hash{}, err
+	}
+	defer lock.release()
+
+	kind, err := existingStoreKind(dataDir)
+	if err != nil {
+		return Hash{}, err
+	}
+	if kind != "" {
+		return Hash{}, fmt.Errorf("The data dir already has a %s block store, remove %s to start a new chain", kind, getDatabaseDirPath(dataDir))
+	}
+
+	// Check the genesis reads back as it was written before it replaces the old one
+	genesisFile := GetGenesisJsonFilePath(dataDir)
+	err = writeGenesisToDisk(genesisFile+".tmp", gen)
+	if err != nil {
+		return Hash{}, err
+	}
+	written, err := loadGenesis(genesisFile + ".tmp")
+	if err != nil || written.Hash() != gen.Hash() {
+		os.Remove(genesisFile + ".tmp")
+		return Hash{}, fmt.Errorf("The genesis file doesn't read back as it was written: %v", err)
+	}
+	err = os.Rename(genesisFile+".tmp", genesisFile)
+	if err == nil {
+		err = syncDir(getDatabaseDirPath(dataDir), SyncAlways)
+	}
 	if err != nil {
-		return fmt.Errorf("CWD error: %w", err)
+		return Hash{}, fmt.Errorf("Cannot replace the genesis file: %w", err)
 	}
 
-	tmplFiles := path.Join(cwd, "static", "tmpl", "*.*")
+	return gen.Hash(), nil
+}
+
+// The template the genesis file is written with, the "genesis" template compiled into the binary
+// unless SetGenesisTemplate replaces it
+var genesisTemplate = template.Must(template.ParseFS(static.Templates, "tmpl/genesis.gojson")).Lookup("genesis")
 
-	// Parse the template directory
-	// If we create more templates then this parse needs to be in an init
-	// somewhere else
-	tmpls, err := template.New("templates").ParseGlob(tmplFiles)
+// SetGenesisTemplate writes genesis files with the template in the file rather than the built in one
+// The file can define a "genesis" template or be the template itself
+func SetGenesisTemplate(file string) error {
+	tmpls, err := template.ParseFiles(file)
 	if err != nil {
 		return fmt.Errorf("Template parse error: %w", err)
 	}
+	if tmpl := tmpls.Lookup("genesis"); tmpl != nil {
+		genesisTemplate = tmpl
+	} else {
+		genesisTemplate = tmpls
+	}
+	return nil
+}
+
+func writeGenesisToDisk(genesisFile string, gen Genesis) error {
 	f, err := os.Create(genesisFile)
 	if err != nil {
 		return fmt.Errorf("Cannot create gensis file '%s': %w", genesisFile, err)
 	}
-	err = tmpls.ExecuteTemplate(f, "genesis", map[string]interface{}{
-		"genesisTime": time.Now().Format(time.RFC3339Nano),
-		"chainId":     "the-refactored-blockchain-bar-ledger",
-		"balances":    Balances{"andrej": 10000, "tim": 20000}, // Tim getting in early before the encryption stops him!!
+	err = genesisTemplate.Execute(f, map[string]interface{}{
+		"genesisTime":      gen.GenesisTime,
+		"chainId":          gen.ChainID,
+		"balances":         gen.Balances,
+		"difficulty":       gen.Difficulty,
+		"retargetInterval": gen.RetargetInterval,
+		"blockTime":        gen.BlockTime,
+		"blockReward":      gen.BlockReward,
+		"maxTimeDrift":     gen.MaxTimeDrift,
+		"minFee":           gen.MinFee,
 	})
-	f.Close()
 	if err != nil {
+		f.Close()
 		os.Remove(genesisFile)
 		return fmt.Errorf("Template execution error: %w", err)
 	}
+
+	// The genesis file is only written once, so it's always flushed before it's renamed into place
+	err = syncFile(f, SyncAlways)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(genesisFile)
+		return fmt.Errorf("Cannot write genesis file '%s': %w", genesisFile, err)
+	}
 	return nil
 }
@@ -0,0 +1,184 @@
+package dao
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestGenesisHash(t *testing.T) {
+	gen := Genesis{
+		GenesisTime:      "2020-06-01T00:00:00Z",
+		ChainID:          "tbb-test",
+		Balances:         Balances{"andrej": 1000, "babayaga": 500},
+		Difficulty:       16,
+		RetargetInterval: 10,
+		BlockTime:        15,
+		BlockReward:      100,
+		MaxTimeDrift:     7200,
+		MinFee:           1,
+	}
+
+	// Pins the encoding of the genesis, a change breaks every existing chain
+	if got, want := gen.Hash().Hex(), "c6e1317ac45ef661c6893563b1239dfedc4195810c3fb53823831b009d483aad"; got != want {
+		t.Errorf("got hash %s; want %s", got, want)
+	}
+
+	changed := gen
+	changed.Balances = Balances{"andrej": 1000, "babayaga": 501}
+	if changed.Hash() == gen.Hash() {
+		t.Error("a different balance should change the genesis hash")
+	}
+}
+
+func TestLoadGenesis(t *testing.T) {
+	testCases := []struct {
+		name        string
+		genesisJson string
+		want        Genesis
+		valid       bool
+	}{
+		{"older genesis", `{"balances": {}}`, Genesis{Balances: Balances{}, Difficulty: DefaultDifficulty, RetargetInterval: DefaultRetargetInterval, BlockTime: DefaultBlockTime, BlockReward: DefaultBlockReward, MaxTimeDrift: DefaultMaxTimeDrift}, true},
+		{"zero parameters", `{"difficulty": 0, "block_reward": 0, "max_time_drift": 0, "balances": {}}`, Genesis{Balances: Balances{}, RetargetInterval: DefaultRetargetInterval, BlockTime: DefaultBlockTime}, true},
+		{"retarget every block", `{"retarget_interval": 1, "balances": {}}`, Genesis{}, false},
+		{"zero block time", `{"block_time": 0, "balances": {}}`, Genesis{}, false},
+		{"balance of a name", `{"balances": {"tim": 20000}}`, Genesis{}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(newTestDataDir(t), "genesis.json")
+			if err := ioutil.WriteFile(path, []byte(tc.genesisJson), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			gen, err := loadGenesis(path)
+			if (err == nil) != tc.valid {
+				t.Fatalf("got %v; want valid %t", err, tc.valid)
+			}
+			if tc.valid && !reflect.DeepEqual(gen, tc.want) {
+				t.Errorf("got %+v; want %+v", gen, tc.want)
+			}
+		})
+	}
+}
+
+func TestBlocksOfAnotherGenesisAreRefused(t *testing.T) {
+	s, _ := newTestChainOnDisk(t, 2)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	genesisJson := fmt.Sprintf(`{"difficulty": 1, "balances": {"%s": 101}}`, andrej.account)
+	if err := ioutil.WriteFile(GetGenesisJsonFilePath(s.dataDir), []byte(genesisJson), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadStateFromDisk(s.dataDir)
+	if err == nil || !strings.Contains(err.Error(), s.GenesisHash().Hex()) {
+		t.Errorf("got %v; want the blocks refused as they follow genesis '%s'", err, s.GenesisHash().Hex())
+	}
+}
+
+func TestWriteGenesis(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	gen := NewGenesis("tbb-test", Balances{andrej.account: 1000})
+	gen.Difficulty = 1
+
+	hash, err := WriteGenesis(dataDir, gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := LoadStateFromDisk(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GenesisHash() != hash {
+		t.Errorf("got genesis hash %s; want %s", s.GenesisHash().Hex(), hash.Hex())
+	}
+	if s.Balances[andrej.account] != 1000 {
+		t.Errorf("got balance %d; want 1000", s.Balances[andrej.account])
+	}
+	if _, err := s.AddBlock(mineTestBlock(t, s, andrej.account, []SignedTx{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := WriteGenesis(dataDir, gen); err == nil {
+		t.Error("replaced the genesis of a chain with blocks")
+	}
+
+	// The chain parameters are written as they are or refused
+	testCases := []struct {
+		name   string
+		change func(g *Genesis)
+		valid  bool
+	}{
+		{"no block reward", func(g *Genesis) { g.BlockReward = 0 }, true},
+		{"no difficulty", func(g *Genesis) { g.Difficulty = 0 }, true},
+		{"no time drift", func(g *Genesis) { g.MaxTimeDrift = 0 }, true},
+		{"no block time", func(g *Genesis) { g.BlockTime = 0 }, false},
+		{"retarget every block", func(g *Genesis) { g.RetargetInterval = 1 }, false},
+		{"difficulty over 255", func(g *Genesis) { g.Difficulty = 256 }, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gen := NewGenesis("tbb-test", Balances{andrej.account: 1000})
+			tc.change(&gen)
+
+			dataDir := newTestDataDir(t)
+			_, err := WriteGenesis(dataDir, gen)
+			if (err == nil) != tc.valid {
+				t.Fatalf("got %v; want valid %t", err, tc.valid)
+			}
+			if !tc.valid {
+				return
+			}
+			written, err := loadGenesis(GetGenesisJsonFilePath(dataDir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(written, gen) {
+				t.Errorf("wrote %+v; want %+v", written, gen)
+			}
+		})
+	}
+}
+
+func TestSetGenesisTemplate(t *testing.T) {
+	defer func(tmpl *template.Template) { genesisTemplate = tmpl }(genesisTemplate)
+
+	tmplFile := filepath.Join(newTestDataDir(t), "genesis.tmpl")
+	tmpl := `{"note": "written with my template", "genesis_time": "{{ $.genesisTime }}", "chain_id": "{{ $.chainId }}",` +
+		` "difficulty": {{ $.difficulty }}, "retarget_interval": {{ $.retargetInterval }}, "block_time": {{ $.blockTime }},` +
+		` "block_reward": {{ $.blockReward }}, "max_time_drift": {{ $.maxTimeDrift }}, "min_fee": {{ $.minFee }}, "balances": {}}`
+	if err := ioutil.WriteFile(tmplFile, []byte(tmpl), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetGenesisTemplate(tmplFile); err != nil {
+		t.Fatal(err)
+	}
+
+	dataDir := newTestDataDir(t)
+	if _, err := WriteGenesis(dataDir, NewGenesis("tbb-test", Balances{})); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(GetGenesisJsonFilePath(dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "written with my template") {
+		t.Errorf("got genesis %s; want it written with the template", content)
+	}
+
+	// The template drops the balances, so the genesis doesn't read back as it was written
+	if _, err := WriteGenesis(newTestDataDir(t), NewGenesis("tbb-test", Balances{andrej.account: 1})); err == nil {
+		t.Error("wrote a genesis that loses the balances")
+	}
+}
@@ -0,0 +1,116 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+)
+
+// How many blocks are read at a time whilst the balances are replayed
+// The state is only locked to read each batch, so mining and syncing carry on in between.
+var replayBatchSize = 100
+
+// GetLatestBalances returns the balances after the latest block, along with the block
+func GetLatestBalances(s *State) (Balances, BlockFS) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.copy().Balances, BlockFS{s.latestBlockHash, s.latestBlock}
+}
+
+// GetBalancesAtHeight returns the balances as they were after the block at the height
+func GetBalancesAtHeight(height uint64, s *State) (Balances, BlockFS, error) {
+	s.mu.Lock()
+	blockFs, err := s.blocks.GetByHeight(height)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, BlockFS{}, err
+	}
+
+	balances, err := s.balancesAfter(blockFs)
+	return balances, blockFs, err
+}
+
+// GetBalancesAtHash returns the balances as they were after the block with the hash
+func GetBalancesAtHash(blockHash Hash, s *State) (Balances, BlockFS, error) {
+	s.mu.Lock()
+	blockFs, err := s.blocks.GetByHash(blockHash)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, BlockFS{}, err
+	}
+
+	balances, err := s.balancesAfter(blockFs)
+	return balances, blockFs, err
+}
+
+// Replay the balances up to and including the block
+// The replay starts from the newest snapshot at or before the block, so only the blocks
+// after the snapshot are applied. They're applied to a state of its own without holding
+// the lock, which is only taken to read the snapshot and each batch of blocks.
+func (s *State) balancesAfter(blockFs BlockFS) (Balances, error) {
+	height := blockFs.Value.Header.BlockNumber
+
+	past, err := newGenesisState(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	past.now = s.now
+
+	s.mu.Lock()
+	if s.hasGenesisBlock && blockFs.Key == s.latestBlockHash {
+		balances := s.copy().Balances
+		s.mu.Unlock()
+		return balances, nil
+	}
+	past.blocks = s.blocks
+	from := uint64(0)
+	if past.restoreSnapshotUpTo(height) {
+		from = past.latestBlock.Header.BlockNumber + 1
+	}
+	past.blocks = nil
+	s.mu.Unlock()
+
+	for from <= height {
+		batch, err := s.readReplayBatch(blockFs, from)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return nil, fmt.Errorf("Cannot replay the balances to block %d, there are no blocks after %d", height, from)
+		}
+		for _, batchBlockFs := range batch {
+			if err := past.applyBlockFs(batchBlockFs); err != nil {
+				return nil, fmt.Errorf("Cannot replay the balances to block %d: %w", height, err)
+			}
+		}
+		from += uint64(len(batch))
+	}
+
+	return past.Balances, nil
+}
+
+// Read the next batch of blocks from the height from, stopping at the block being replayed to
+// The chain can be reorganised between batches, so the block is checked to still be in it.
+func (s *State) readReplayBatch(blockFs BlockFS, from uint64) ([]BlockFS, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	height := blockFs.Value.Header.BlockNumber
+	if !s.hasBlock(height, blockFs.Key) {
+		return nil, fmt.Errorf("%w: block %d '%s' was replaced whilst the balances were replayed", ErrBlockNotFound, height, blockFs.Key.Hex())
+	}
+
+	batch := make([]BlockFS, 0, replayBatchSize)
+	err := s.blocks.Iterate(from, func(next BlockFS) error {
+		if next.Value.Header.BlockNumber > height || len(batch) == replayBatchSize {
+			return errStopIterating
+		}
+		batch = append(batch, next)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopIterating) {
+		return nil, fmt.Errorf("Cannot read the blocks to replay the balances to block %d: %w", height, err)
+	}
+
+	return batch, nil
+}
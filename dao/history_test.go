@@ -0,0 +1,59 @@
+package dao
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestGetBalancesAtEarlierBlocks(t *testing.T) {
+	defer func(size int) { replayBatchSize = size }(replayBatchSize)
+	replayBatchSize = 2
+
+	s, _ := newTestChainOnDisk(t, 0)
+	defer s.Close()
+
+	// The balances after each block, with a snapshot part way so some are replayed from it
+	hashes := make([]Hash, 0)
+	want := make([]Balances, 0)
+	for i := uint64(0); i < 5; i++ {
+		hashes = append(hashes, addTestBlocks(t, s, andrej.account, []SignedTx{andrej.signTx(babayaga.account, i, 10, 0, "vodka")})...)
+		if i == 2 {
+			if _, err := s.Snapshot(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want = append(want, s.copy().Balances)
+	}
+
+	for height := range want {
+		balances, blockFs, err := GetBalancesAtHeight(uint64(height), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blockFs.Key != hashes[height] || !reflect.DeepEqual(balances, want[height]) {
+			t.Errorf("got balances %v after block '%s'; want %v after block %d '%s'", balances, blockFs.Key.Hex(), want[height], height, hashes[height].Hex())
+		}
+
+		balances, _, err = GetBalancesAtHash(hashes[height], s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(balances, want[height]) {
+			t.Errorf("got balances %v after block '%s'; want %v", balances, hashes[height].Hex(), want[height])
+		}
+	}
+
+	if _, _, err := GetBalancesAtHeight(5, s); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v; want %v", err, ErrBlockNotFound)
+	}
+	if _, _, err := GetBalancesAtHash(Hash{0x01}, s); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v; want %v", err, ErrBlockNotFound)
+	}
+
+	// A block replaced by a reorganisation part way through the replay
+	replaced := BlockFS{Hash{0x01}, Block{Header: BlockHeader{BlockNumber: 3}}}
+	if _, err := s.readReplayBatch(replaced, 0); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v; want %v", err, ErrBlockNotFound)
+	}
+}
@@ -0,0 +1,246 @@
+package dao
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Each index record is the block hash followed by the offset of the block in the block file
+const indexRecordSize = len(Hash{}) + 8
+
+// The indexes are rebuilt from the blocks whenever they don't match them, so an index file
+// that can't be updated only costs the time to rebuild it the next time the blocks are loaded
+func warnIndexRebuilt(err error) {
+	if err != nil {
+		fmt.Printf("WARNING: %s, it will be rebuilt when the blocks are next loaded\n", err)
+	}
+}
+
+// The block index finds a block in the block file without reading the blocks before it
+//
+// The record of block N is the Nth record of the index file, so a block is found by its
+// height with a single seek. The hashes are kept in memory to find the height of a hash.
+// The index is rebuilt from the block file whenever it is missing or doesn't match it.
+type blockIndex struct {
+	path    string
+	offsets []int64         // The offset of each block in the block file by height
+	hashes  []Hash          // The hash of each block by height
+	heights map[Hash]uint64 // The height of each block by hash
+	size    int64           // The size of the block file covered by the index
+
+	syncPolicy SyncPolicy // When the index file is flushed to the disk after it's replaced
+}
+
+func newBlockIndex(path string) *blockIndex {
+	return &blockIndex{path, make([]int64, 0), make([]Hash, 0), make(map[Hash]uint64), 0, SyncAlways}
+}
+
+// Load the index of the block file, rebuilding it if it doesn't match the block file
+// Opened read only a rebuilt index is only kept in memory.
+func loadBlockIndex(dataDir string, readOnly bool) (*blockIndex, error) {
+	index, err := readBlockIndex(dataDir)
+	if err == nil {
+		return index, nil
+	}
+
+	// A missing index is expected for a new data dir or one from before there was an index
+	if !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Rebuilding the block index: %s\n", err)
+	}
+
+	return rebuildBlockIndex(dataDir, !readOnly)
+}
+
+func readBlockIndex(dataDir string) (*blockIndex, error) {
+	content, err := ioutil.ReadFile(getBlockIndexFilePath(dataDir))
+	if err != nil {
+		return nil, err
+	}
+	if len(content)%indexRecordSize != 0 {
+		return nil, fmt.Errorf("the index has a partial record")
+	}
+
+	index := newBlockIndex(getBlockIndexFilePath(dataDir))
+	for i := 0; i < len(content); i += indexRecordSize {
+		var hash Hash
+		copy(hash[:], content[i:])
+		offset := int64(binary.BigEndian.Uint64(content[i+len(hash):]))
+
+		if len(index.offsets) > 0 && offset <= index.offsets[len(index.offsets)-1] {
+			return nil, fmt.Errorf("the offset of block %d is out of order", len(index.offsets))
+		}
+		index.heights[hash] = uint64(len(index.hashes))
+		index.hashes = append(index.hashes, hash)
+		index.offsets = append(index.offsets, offset)
+	}
+
+	f, err := os.Open(getBlocksDbFilePath(dataDir))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The last record must point to the last block in the block file
+	if len(index.hashes) > 0 {
+		latest := len(index.hashes) - 1
+		blockFs, next, err := readBlockAt(f, index.offsets[latest])
+		if err != nil {
+			return nil, err
+		}
+		if blockFs.Key != index.hashes[latest] {
+			return nil, fmt.Errorf("the index points to block '%s' not '%s'", blockFs.Key.Hex(), index.hashes[latest].Hex())
+		}
+		index.size = next
+	}
+	if _, err := readLine(f, index.size); err != io.EOF {
+		return nil, fmt.Errorf("the block file continues after the last indexed block")
+	}
+
+	return index, nil
+}
+
+// Scan the block file for a new index, written to the index file when write is set
+func rebuildBlockIndex(dataDir string, write bool) (*blockIndex, error) {
+	f, err := os.Open(getBlocksDbFilePath(dataDir))
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the local blocks file: %w", err)
+	}
+	defer f.Close()
+
+	index := newBlockIndex(getBlockIndexFilePath(dataDir))
+	for {
+		blockFs, next, err := readBlockAt(f, index.size)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		index.add(blockFs.Key, next-index.size)
+	}
+
+	if write {
+		err = index.write()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return index, nil
+}
+
+// Remove the blocks from the height length onwards from the index
+func (i *blockIndex) truncate(length uint64) error {
+	if length >= uint64(len(i.hashes)) {
+		return nil
+	}
+
+	for _, hash := range i.hashes[length:] {
+		delete(i.heights, hash)
+	}
+	i.size = i.offsets[length]
+	i.hashes = i.hashes[:length]
+	i.offsets = i.offsets[:length]
+
+	return i.write()
+}
+
+// Replace the index file with the whole index
+func (i *blockIndex) write() error {
+	records := make([]byte, 0, len(i.hashes)*indexRecordSize)
+	for height := range i.hashes {
+		records = append(records, i.record(height)...)
+	}
+
+	err := writeFileAtomically(i.path, records, i.syncPolicy)
+	if err != nil {
+		return fmt.Errorf("Cannot write the block index: %w", err)
+	}
+
+	return nil
+}
+
+// Record a block of length bytes added to the end of the block file
+// The index in memory is always updated, see warnIndexRebuilt for when the file can't be
+func (i *blockIndex) append(hash Hash, length int64) error {
+	i.add(hash, length)
+	record := i.record(len(i.hashes) - 1)
+
+	f, err := os.OpenFile(i.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Cannot open the block index: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(record)
+	if err != nil {
+		return fmt.Errorf("Cannot append to the block index: %w", err)
+	}
+
+	return nil
+}
+
+// Add a block of length bytes at the end of the block file to the index in memory
+func (i *blockIndex) add(hash Hash, length int64) {
+	i.heights[hash] = uint64(len(i.hashes))
+	i.hashes = append(i.hashes, hash)
+	i.offsets = append(i.offsets, i.size)
+	i.size += length
+}
+
+// The record of the block at the height in the index file
+func (i *blockIndex) record(height int) []byte {
+	record := make([]byte, indexRecordSize)
+	copy(record, i.hashes[height][:])
+	binary.BigEndian.PutUint64(record[len(Hash{}):], uint64(i.offsets[height]))
+	return record
+}
+
+func (i *blockIndex) offsetOfHeight(height uint64) (int64, bool) {
+	if height >= uint64(len(i.offsets)) {
+		return 0, false
+	}
+	return i.offsets[height], true
+}
+
+func (i *blockIndex) heightOfHash(hash Hash) (uint64, bool) {
+	height, ok := i.heights[hash]
+	return height, ok
+}
+
+// Read the block that starts at the offset of the block file
+// It returns the offset of the block after it
+func readBlockAt(f *os.File, offset int64) (BlockFS, int64, error) {
+	line, err := readLine(f, offset)
+	if err != nil {
+		return BlockFS{}, 0, err
+	}
+
+	var blockFs BlockFS
+	err = json.Unmarshal(line, &blockFs)
+	if err != nil {
+		return BlockFS{}, 0, fmt.Errorf("Cannot interpret json %v: %w", line, err)
+	}
+
+	return blockFs, offset + int64(len(line)), nil
+}
+
+// Read a whole line including the newline, io.EOF means there are no more lines
+func readLine(f *os.File, offset int64) ([]byte, error) {
+	reader := bufio.NewReader(io.NewSectionReader(f, offset, 1<<62))
+	line, err := reader.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		return nil, errors.New("the block file ends with a partial line")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return line, nil
+}
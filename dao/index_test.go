@@ -0,0 +1,106 @@
+package dao
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestGetBlocksFromTheIndex(t *testing.T) {
+	s, hashes := newTestChainOnDisk(t, 4)
+	defer s.Close()
+
+	for height, hash := range hashes {
+		byHeight, err := GetBlockByHeight(uint64(height), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if byHeight.Key != hash {
+			t.Errorf("got block '%s' at height %d; want '%s'", byHeight.Key.Hex(), height, hash.Hex())
+		}
+
+		byHash, err := GetBlockByHash(hash, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if byHash.Value.Header.BlockNumber != uint64(height) {
+			t.Errorf("got block %d for '%s'; want %d", byHash.Value.Header.BlockNumber, hash.Hex(), height)
+		}
+	}
+
+	if _, err := GetBlockByHeight(uint64(len(hashes)), s); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v beyond the latest block; want %v", err, ErrBlockNotFound)
+	}
+
+	testCases := []struct {
+		name  string
+		after Hash
+		want  int
+	}{
+		{"from the start", Hash{}, 4},
+		{"after the first block", hashes[0], 3},
+		{"after the latest block", hashes[3], 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := GetBlocksAfter(tc.after, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != tc.want {
+				t.Errorf("got %d blocks; want %d", len(blocks), tc.want)
+			}
+		})
+	}
+}
+
+func TestBlockIndexIsRebuilt(t *testing.T) {
+	testCases := []struct {
+		name    string
+		damage  func(path string) error
+		rebuilt bool
+	}{
+		{"intact", func(path string) error { return nil }, false},
+		{"missing", os.Remove, true},
+		{"truncated", func(path string) error { return os.Truncate(path, int64(indexRecordSize+3)) }, true},
+		{"behind the block file", func(path string) error { return os.Truncate(path, int64(indexRecordSize)) }, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, hashes := newTestChainOnDisk(t, 3)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			indexPath := getBlockIndexFilePath(s.dataDir)
+			if err := tc.damage(indexPath); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := readBlockIndex(s.dataDir); (err != nil) != tc.rebuilt {
+				t.Errorf("got %v reading the index; want it rebuilt %t", err, tc.rebuilt)
+			}
+
+			reloaded, err := LoadStateFromDisk(s.dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reloaded.Close()
+
+			block, err := GetBlockByHeight(2, reloaded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.Key != hashes[2] {
+				t.Errorf("got block '%s'; want '%s'", block.Key.Hex(), hashes[2].Hex())
+			}
+			content, err := ioutil.ReadFile(indexPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(content) != 3*indexRecordSize {
+				t.Errorf("the index file is %d bytes; want %d", len(content), 3*indexRecordSize)
+			}
+		})
+	}
+}
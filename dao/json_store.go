@@ -0,0 +1,146 @@
+package dao
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// The json store writes each block as a line of json to the block file
+// The block index finds a block by its height or hash without scanning the file.
+type jsonStore struct {
+	f          *os.File    // The block file, open for append as well as read
+	index      *blockIndex // Where each block is in the block file
+	syncPolicy SyncPolicy  // When the blocks written to the block file are flushed to the disk
+}
+
+func openJSONStore(dataDir string, readOnly bool) (*jsonStore, error) {
+	blockDbFilePath := getBlocksDbFilePath(dataDir)
+	if !readOnly && !fileExist(blockDbFilePath) {
+		if err := writeEmptyBlocksDbToDisk(blockDbFilePath); err != nil {
+			return nil, fmt.Errorf("Could not create empty block file: %w", err)
+		}
+	}
+
+	err := recoverBlockFile(dataDir, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := loadBlockIndex(dataDir, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load the block index: %w", err)
+	}
+
+	flag := os.O_APPEND | os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(blockDbFilePath, flag, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open block file: %w", err)
+	}
+
+	return &jsonStore{f, index, SyncAlways}, nil
+}
+
+func (js *jsonStore) Kind() StoreKind {
+	return StoreJSON
+}
+
+func (js *jsonStore) Len() uint64 {
+	return uint64(len(js.index.hashes))
+}
+
+func (js *jsonStore) Append(blockFs BlockFS) error {
+	blockFsJson, err := json.Marshal(blockFs)
+	if err != nil {
+		return fmt.Errorf("Cannot convert to json %v: %w", blockFs.Value, err)
+	}
+
+	_, err = js.f.Write(append(blockFsJson, '\n'))
+	if err == nil {
+		err = syncFile(js.f, js.syncPolicy)
+	}
+	if err != nil {
+		// Don't leave part of the block for the next block to be appended to
+		if truncErr := js.f.Truncate(js.index.size); truncErr != nil {
+			fmt.Printf("WARNING: Cannot remove the partial block: %s\n", truncErr)
+		}
+		return fmt.Errorf("Cannot append json to file %v: %w", blockFsJson, err)
+	}
+
+	warnIndexRebuilt(js.index.append(blockFs.Key, int64(len(blockFsJson)+1)))
+
+	return nil
+}
+
+func (js *jsonStore) GetByHeight(height uint64) (BlockFS, error) {
+	offset, ok := js.index.offsetOfHeight(height)
+	if !ok {
+		return BlockFS{}, fmt.Errorf("%w: height %d", ErrBlockNotFound, height)
+	}
+
+	blockFs, _, err := readBlockAt(js.f, offset)
+	return blockFs, err
+}
+
+func (js *jsonStore) GetByHash(hash Hash) (BlockFS, error) {
+	height, ok := js.index.heightOfHash(hash)
+	if !ok {
+		return BlockFS{}, fmt.Errorf("%w: '%s'", ErrBlockNotFound, hash.Hex())
+	}
+
+	return js.GetByHeight(height)
+}
+
+func (js *jsonStore) Iterate(from uint64, fn func(BlockFS) error) error {
+	offset, ok := js.index.offsetOfHeight(from)
+	if !ok {
+		return nil
+	}
+
+	for offset < js.index.size {
+		blockFs, next, err := readBlockAt(js.f, offset)
+		if err != nil {
+			return err
+		}
+		if err := fn(blockFs); err != nil {
+			return err
+		}
+		offset = next
+	}
+
+	return nil
+}
+
+// The block file is cut back first, if the index can't follow it's rebuilt on the next load
+func (js *jsonStore) Truncate(length uint64) error {
+	offset, ok := js.index.offsetOfHeight(length)
+	if !ok {
+		return nil
+	}
+
+	err := js.f.Truncate(offset)
+	if err == nil {
+		err = syncFile(js.f, js.syncPolicy)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot remove the blocks from block %d on: %w", length, err)
+	}
+
+	return js.index.truncate(length)
+}
+
+func (js *jsonStore) SetSyncPolicy(policy SyncPolicy) {
+	js.syncPolicy = policy
+	js.index.syncPolicy = policy
+}
+
+func (js *jsonStore) Close() error {
+	err := js.f.Close()
+	if err != nil {
+		return fmt.Errorf("Could not close the block file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrDataDirLocked is returned when another process has the data dir open
+var ErrDataDirLocked = errors.New("the data dir is in use by another process")
+
+// ErrReadOnly is returned when a state opened read only is asked to change the data dir
+var ErrReadOnly = errors.New("the data dir was opened read only")
+
+// The lock on the data dir held for as long as the state is open
+//
+// A process that writes to the data dir holds the lock exclusively, processes that only
+// read it share the lock, so a reader never sees a block that's half written. The lock
+// file holds the PID of the latest process to take the lock so the error can name it.
+type dataDirLock struct {
+	f *os.File
+}
+
+func lockDataDir(dataDir string, shared bool) (*dataDirLock, error) {
+	f, err := os.OpenFile(getLockFilePath(dataDir), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open the lock file: %w", err)
+	}
+
+	locked, err := lockFile(f, shared)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Cannot lock the data dir: %w", err)
+	}
+	if !locked {
+		f.Close()
+		return nil, fmt.Errorf("The data dir '%s' is in use by process %s, stop it or send the command to its node: %w", dataDir, lockHolder(dataDir), ErrDataDirLocked)
+	}
+
+	// The PID is only for the error message, the lock is still held if it can't be written
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt(pid, 0)
+	}
+
+	return &dataDirLock{f}, nil
+}
+
+// The PID written to the lock file by the process holding it
+func lockHolder(dataDir string) string {
+	content, err := ioutil.ReadFile(getLockFilePath(dataDir))
+	pid := strings.TrimSpace(string(content))
+	if err != nil || pid == "" {
+		return "unknown"
+	}
+	return pid
+}
+
+// Closing the lock file releases the lock
+func (l *dataDirLock) release() error {
+	if l == nil {
+		return nil
+	}
+	err := l.f.Close()
+	if err != nil {
+		return fmt.Errorf("Could not release the data dir lock: %w", err)
+	}
+	return nil
+}
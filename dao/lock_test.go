@@ -0,0 +1,120 @@
+package dao
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDataDirLock(t *testing.T) {
+	s, _ := newTestChainOnDisk(t, 1)
+
+	_, err := LoadStateFromDisk(s.dataDir)
+	if !errors.Is(err, ErrDataDirLocked) || !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Errorf("got %v; want the data dir locked by process %d", err, os.Getpid())
+	}
+	if _, err := LoadStateReadOnly(s.dataDir); !errors.Is(err, ErrDataDirLocked) {
+		t.Errorf("got %v; want the data dir locked whilst it's written", err)
+	}
+	if _, err := WriteGenesis(s.dataDir, NewGenesis("tbb-test", Balances{})); !errors.Is(err, ErrDataDirLocked) {
+		t.Errorf("got %v; want the genesis refused whilst the data dir is open", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers share the data dir but keep writers out
+	reader, err := LoadStateReadOnly(s.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	otherReader, err := LoadStateReadOnly(s.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherReader.Close()
+	if _, err := LoadStateFromDisk(s.dataDir); !errors.Is(err, ErrDataDirLocked) {
+		t.Errorf("got %v; want the data dir locked whilst it's read", err)
+	}
+
+	if reader.LatestBlockHash() != s.LatestBlockHash() {
+		t.Errorf("read only state is at '%s'; want '%s'", reader.LatestBlockHash().Hex(), s.LatestBlockHash().Hex())
+	}
+	if _, err := reader.AddBlock(mineTestBlock(t, reader, andrej.account, []SignedTx{})); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("got %v; want a block refused by a read only state", err)
+	}
+	if _, err := reader.Snapshot(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("got %v; want a snapshot refused by a read only state", err)
+	}
+}
+
+func TestReadOnlyLeavesTheDataDirAlone(t *testing.T) {
+	s, _ := newTestChainOnDisk(t, 2)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an index it's rebuilt in memory
+	if err := os.Remove(getBlockIndexFilePath(s.dataDir)); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := LoadStateReadOnly(s.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.LatestBlockHash() != s.LatestBlockHash() {
+		t.Errorf("read only state is at '%s'; want '%s'", reader.LatestBlockHash().Hex(), s.LatestBlockHash().Hex())
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fileExist(getBlockIndexFilePath(s.dataDir)) {
+		t.Error("a read only state wrote the block index")
+	}
+
+	// A block cut off by a crash is left for a writer to remove
+	f, err := os.OpenFile(getBlocksDbFilePath(s.dataDir), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"hash":"00a1","block":{"header":{"par`); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(getBlocksDbFilePath(s.dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadStateReadOnly(s.dataDir); err == nil {
+		t.Error("a read only state loaded a block file with a partial block")
+	}
+	after, err := ioutil.ReadFile(getBlocksDbFilePath(s.dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Error("a read only state changed the block file")
+	}
+}
+
+func TestLoadingNeedsAGenesis(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "tbb")
+
+	if _, err := LoadStateReadOnly(dataDir); err == nil {
+		t.Error("loaded a read only state without a genesis file")
+	}
+	if _, err := LoadStateFromDisk(dataDir); err == nil {
+		t.Error("loaded a state without a genesis file")
+	}
+	if fileExist(dataDir) {
+		t.Error("loading a state without a genesis file created the data dir")
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package dao
+
+import (
+	"os"
+	"syscall"
+)
+
+// Take the flock of the file without waiting, false when another process holds it
+// The OS releases the lock when the file is closed, even if the process crashes.
+func lockFile(f *os.File, shared bool) (bool, error) {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,34 @@
+package dao
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// LockFileEx isn't in the syscall package so it's called from kernel32
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const lockfileFailImmediately = 0x1
+const lockfileExclusiveLock = 0x2
+const errorLockViolation syscall.Errno = 33
+
+// Take the lock of the file without waiting, false when another process holds it
+// Windows releases the lock when the file is closed, even if the process crashes. A locked
+// range can't be read by other processes so the lock is on a byte well past the PID.
+func lockFile(f *os.File, shared bool) (bool, error) {
+	flags := uint32(lockfileFailImmediately)
+	if !shared {
+		flags |= lockfileExclusiveLock
+	}
+
+	overlapped := &syscall.Overlapped{OffsetHigh: 1}
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(overlapped)))
+	if r != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation {
+		return false, nil
+	}
+	return false, err
+}
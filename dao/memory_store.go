@@ -0,0 +1,67 @@
+package dao
+
+import "fmt"
+
+// The memory store keeps the blocks in a slice, it's for tests and nodes that needn't keep the chain
+type memoryStore struct {
+	blocks  []BlockFS
+	heights map[Hash]uint64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{make([]BlockFS, 0), make(map[Hash]uint64)}
+}
+
+func (m *memoryStore) Kind() StoreKind {
+	return StoreMemory
+}
+
+func (m *memoryStore) Len() uint64 {
+	return uint64(len(m.blocks))
+}
+
+func (m *memoryStore) Append(blockFs BlockFS) error {
+	m.heights[blockFs.Key] = uint64(len(m.blocks))
+	m.blocks = append(m.blocks, blockFs)
+	return nil
+}
+
+func (m *memoryStore) GetByHeight(height uint64) (BlockFS, error) {
+	if height >= m.Len() {
+		return BlockFS{}, fmt.Errorf("%w: height %d", ErrBlockNotFound, height)
+	}
+	return m.blocks[height], nil
+}
+
+func (m *memoryStore) GetByHash(hash Hash) (BlockFS, error) {
+	height, ok := m.heights[hash]
+	if !ok {
+		return BlockFS{}, fmt.Errorf("%w: '%s'", ErrBlockNotFound, hash.Hex())
+	}
+	return m.blocks[height], nil
+}
+
+func (m *memoryStore) Iterate(from uint64, fn func(BlockFS) error) error {
+	for height := from; height < m.Len(); height++ {
+		if err := fn(m.blocks[height]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Truncate(length uint64) error {
+	for height := length; height < m.Len(); height++ {
+		delete(m.heights, m.blocks[height].Key)
+	}
+	if length < m.Len() {
+		m.blocks = m.blocks[:length]
+	}
+	return nil
+}
+
+func (m *memoryStore) SetSyncPolicy(policy SyncPolicy) {}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
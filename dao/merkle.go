@@ -0,0 +1,105 @@
+package dao
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// Leaves and nodes are hashed with a different prefix so a node can never
+// be passed off as a transaction
+const merkleLeafPrefix = 0x00
+const merkleNodePrefix = 0x01
+
+// MerkleNode is one step along the path from a transaction to the Merkle root
+type MerkleNode struct {
+	Hash Hash `json:"hash"`
+	Left bool `json:"left"` // The hash goes on the left when combined
+}
+
+// MerkleProof is the path of sibling hashes from a transaction up to the Merkle root
+type MerkleProof []MerkleNode
+
+// MerkleRoot summarises all the transactions in a block in a single hash
+//
+// Each level pairs up the hashes below it, an odd hash out at the end of a level
+// moves up a level unchanged. There is no root without transactions.
+func MerkleRoot(txs []SignedTx) Hash {
+	level := merkleLeaves(txs)
+	if len(level) == 0 {
+		return Hash{}
+	}
+
+	for len(level) > 1 {
+		level = merkleParents(level)
+	}
+
+	return level[0]
+}
+
+// NewMerkleProof creates the proof that the transaction at index is in the transactions
+func NewMerkleProof(txs []SignedTx, index int) (MerkleProof, error) {
+	if index < 0 || index >= len(txs) {
+		return nil, fmt.Errorf("transaction %d is not in the %d transactions", index, len(txs))
+	}
+
+	level := merkleLeaves(txs)
+	proof := make(MerkleProof, 0)
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, MerkleNode{level[sibling], sibling < index})
+		}
+		level = merkleParents(level)
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// VerifyMerkleProof checks the proof leads from the transaction to the Merkle root
+func VerifyMerkleProof(tx SignedTx, proof MerkleProof, root Hash) bool {
+	hash := merkleLeaf(tx.Hash())
+	for _, node := range proof {
+		if node.Left {
+			hash = merkleParent(node.Hash, hash)
+		} else {
+			hash = merkleParent(hash, node.Hash)
+		}
+	}
+
+	return hash == root
+}
+
+func merkleLeaves(txs []SignedTx) []Hash {
+	leaves := make([]Hash, len(txs))
+	for i, tx := range txs {
+		leaves[i] = merkleLeaf(tx.Hash())
+	}
+
+	return leaves
+}
+
+func merkleParents(level []Hash) []Hash {
+	parents := make([]Hash, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			parents = append(parents, level[i])
+			continue
+		}
+		parents = append(parents, merkleParent(level[i], level[i+1]))
+	}
+
+	return parents
+}
+
+func merkleLeaf(txHash Hash) Hash {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, txHash[:]...))
+}
+
+func merkleParent(left Hash, right Hash) Hash {
+	data := make([]byte, 0, 1+2*len(left))
+	data = append(data, merkleNodePrefix)
+	data = append(data, left[:]...)
+	data = append(data, right[:]...)
+	return sha256.Sum256(data)
+}
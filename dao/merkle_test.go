@@ -0,0 +1,45 @@
+package dao
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMerkleProof(t *testing.T) {
+	for count := 1; count <= 7; count++ {
+		txs := make([]SignedTx, count)
+		for i := range txs {
+			txs[i] = andrej.signTx(babayaga.account, uint64(i), 1, 0, "vodka")
+		}
+
+		root := MerkleRoot(txs)
+
+		for i, tx := range txs {
+			t.Run(fmt.Sprintf("tx %d of %d", i, count), func(t *testing.T) {
+				proof, err := NewMerkleProof(txs, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !VerifyMerkleProof(tx, proof, root) {
+					t.Errorf("proof %v doesn't lead to the root '%s'", proof, root.Hex())
+				}
+
+				tampered := tx
+				tampered.Value += 100
+				if VerifyMerkleProof(tampered, proof, root) {
+					t.Error("proof verified a tampered transaction")
+				}
+			})
+		}
+	}
+}
+
+func TestMerkleRootChangesWithOrder(t *testing.T) {
+	a := andrej.signTx(babayaga.account, 0, 1, 0, "vodka")
+	b := babayaga.signTx(andrej.account, 0, 1, 0, "vodka")
+
+	if MerkleRoot([]SignedTx{a, b}) == MerkleRoot([]SignedTx{b, a}) {
+		t.Error("the Merkle root should depend on the order of the transactions")
+	}
+}
@@ -0,0 +1,143 @@
+package dao
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+// SyncPolicy is when blocks written to the block file are flushed to the disk
+type SyncPolicy string
+
+// SyncAlways flushes every block before it's accepted, so a crash can't lose it
+const SyncAlways SyncPolicy = "always"
+
+// SyncNever leaves flushing to the OS, which is faster but a crash can lose the latest blocks
+const SyncNever SyncPolicy = "never"
+
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch SyncPolicy(policy) {
+	case SyncAlways, SyncNever:
+		return SyncPolicy(policy), nil
+	}
+	return "", fmt.Errorf("The sync policy must be '%s' or '%s' not '%s'", SyncAlways, SyncNever, policy)
+}
+
+// SetSyncPolicy changes when the blocks, and the indexes and snapshots, are flushed to the disk
+func (s *State) SetSyncPolicy(policy SyncPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncPolicy = policy
+	s.blocks.SetSyncPolicy(policy)
+	if s.txs != nil {
+		s.txs.syncPolicy = policy
+	}
+}
+
+func syncFile(f *os.File, policy SyncPolicy) error {
+	if policy == SyncNever {
+		return nil
+	}
+	return f.Sync()
+}
+
+// Flush the files created or removed in the directory to the disk
+// Windows can't open a directory to flush it, NTFS journals the renames instead.
+func syncDir(dir string, policy SyncPolicy) error {
+	if policy == SyncNever || runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// How much of the end of the block file is read at a time looking for the last block
+const recoveryChunkSize = 64 * 1024
+
+// Remove the last block from the block file if a crash left it half written
+//
+// Every block is written with its newline at the end, so a crash part way through
+// appending a block leaves the block file without its final newline. Only that
+// partial line is removed, anything else wrong with the file is left to fail the load.
+// Opened read only the partial line is an error, as it can't be removed.
+func recoverBlockFile(dataDir string, readOnly bool) error {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(getBlocksDbFilePath(dataDir), flag, 0600)
+	if err != nil {
+		return fmt.Errorf("Cannot open block file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Cannot read the size of the block file: %w", err)
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil
+	}
+
+	last, err := readByteAt(f, size-1)
+	if err != nil || last == '\n' {
+		return err
+	}
+
+	start, err := lineStartBefore(f, size)
+	if err != nil {
+		return err
+	}
+
+	if readOnly {
+		return fmt.Errorf("The block file ends with %d bytes of a block that was cut off, probably by a crash, open the data dir for writing to remove them", size-start)
+	}
+
+	fmt.Printf("WARNING: The block file ends with %d bytes of a block that was cut off, probably by a crash, they have been removed\n", size-start)
+
+	err = f.Truncate(start)
+	if err != nil {
+		return fmt.Errorf("Cannot remove the partial block: %w", err)
+	}
+
+	return f.Sync()
+}
+
+func readByteAt(f *os.File, offset int64) (byte, error) {
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		return 0, fmt.Errorf("Cannot read the block file: %w", err)
+	}
+	return b[0], nil
+}
+
+// The offset just after the last newline before end, or the start of the file
+func lineStartBefore(f *os.File, end int64) (int64, error) {
+	for end > 0 {
+		chunkStart := end - recoveryChunkSize
+		if chunkStart < 0 {
+			chunkStart = 0
+		}
+
+		chunk := make([]byte, end-chunkStart)
+		if _, err := f.ReadAt(chunk, chunkStart); err != nil && err != io.EOF {
+			return 0, fmt.Errorf("Cannot read the block file: %w", err)
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return chunkStart + int64(i) + 1, nil
+		}
+		end = chunkStart
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,90 @@
+package dao
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPartialBlockIsRemoved(t *testing.T) {
+	s, hashes := newTestChainOnDisk(t, 2)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blockDbFilePath := getBlocksDbFilePath(s.dataDir)
+	info, err := os.Stat(blockDbFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash whilst the third block was being written
+	f, err := os.OpenFile(blockDbFilePath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"hash":"00a1","block":{"header":{"par`); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadStateFromDisk(s.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+
+	if reloaded.LatestBlockHash() != hashes[1] {
+		t.Errorf("latest block is '%s'; want '%s'", reloaded.LatestBlockHash().Hex(), hashes[1].Hex())
+	}
+	recovered, err := os.Stat(blockDbFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.Size() != info.Size() {
+		t.Errorf("the block file is %d bytes; want %d", recovered.Size(), info.Size())
+	}
+
+	// The chain carries on from the last whole block
+	if _, err := reloaded.AddBlock(mineTestBlock(t, reloaded, andrej.account, []SignedTx{})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetBlockByHeight(2, reloaded); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCorruptBlockIsNotRemoved(t *testing.T) {
+	s, _ := newTestChainOnDisk(t, 2)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(getBlocksDbFilePath(s.dataDir), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("{\"hash\":\"00a1\"}garbage\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadStateFromDisk(s.dataDir); err == nil || !strings.Contains(err.Error(), "json") {
+		t.Errorf("got %v; want the whole but corrupt block to fail the load", err)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, policy := range []string{"always", "never"} {
+		if _, err := ParseSyncPolicy(policy); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("an unknown policy should fail")
+	}
+}
@@ -0,0 +1,359 @@
+package dao
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A new segment is started once the latest one is this big
+const segmentMaxSize = 16 * 1024 * 1024
+
+// Each record starts with the length and then the checksum of the block
+const segmentRecordHeaderSize = 8
+
+const segmentFilePrefix = "segment-"
+const segmentFileExt = ".log"
+
+// The segmented store writes the blocks in their binary encoding to a series of segment files
+//
+// Each record in a segment is
+//
+//	length    uint32, the length of the encoded block
+//	checksum  uint32, the CRC-32 (IEEE) of the encoded block
+//	block     the encoded block, which starts with its hash
+//
+// A segment is named after the height of its first block. Opening the store reads the
+// hash of every record to find the blocks by height and hash. Only the checksum of the
+// last record is checked then, to find a block cut off by a crash, the others are
+// checked as they're read.
+type segmentStore struct {
+	dir        string
+	segments   []*segment
+	locations  []blockLocation // Where each block is by height
+	hashes     []Hash          // The hash of each block by height
+	heights    map[Hash]uint64 // The height of each block by hash
+	syncPolicy SyncPolicy      // When the appended blocks are flushed to the disk
+	readOnly   bool            // The segments are opened read only and a cut off block isn't removed
+}
+
+type segment struct {
+	first uint64 // The height of the first block in the segment
+	f     *os.File
+	size  int64
+}
+
+type blockLocation struct {
+	segment int
+	offset  int64
+}
+
+func openSegmentStore(dataDir string, readOnly bool) (*segmentStore, error) {
+	dir := getSegmentsDirPath(dataDir)
+	if !readOnly {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("Error creating segment directory: %w", err)
+		}
+	}
+
+	firsts, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &segmentStore{dir: dir, heights: make(map[Hash]uint64), syncPolicy: SyncAlways, readOnly: readOnly}
+	for i, first := range firsts {
+		if first != store.Len() {
+			store.Close()
+			return nil, fmt.Errorf("Segment '%s' starts at block %d not %d", getSegmentFileName(first), first, store.Len())
+		}
+
+		err = store.openSegment(first, i == len(firsts)-1)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// Open the segment and index its blocks
+// A record cut off at the end of the latest segment is removed. A broken record anywhere
+// else is an error, removing it would remove the blocks after it as well.
+func (ss *segmentStore) openSegment(first uint64, latest bool) error {
+	name := getSegmentFileName(first)
+	flag := os.O_RDWR
+	if ss.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(filepath.Join(ss.dir, name), flag, 0600)
+	if err != nil {
+		return fmt.Errorf("Cannot open segment '%s': %w", name, err)
+	}
+	seg := &segment{first, f, 0}
+	ss.segments = append(ss.segments, seg)
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Cannot read the size of segment '%s': %w", name, err)
+	}
+	size := info.Size()
+
+	for seg.size < size {
+		length, hash, err := readRecordStart(f, seg.size)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Cannot read segment '%s': %w", name, err)
+		}
+		next := seg.size + segmentRecordHeaderSize + int64(length)
+
+		// A crash can only cut off the record being appended, which runs to the end of the segment
+		cutOff := err == io.EOF || next > size
+		if !cutOff && next == size && latest {
+			_, err = readRecord(f, seg.size)
+			cutOff = err != nil
+		}
+		if !cutOff && length < uint32(len(Hash{})) {
+			return fmt.Errorf("Segment '%s' has a broken block at %d", name, seg.size)
+		}
+
+		if cutOff {
+			if !latest {
+				return fmt.Errorf("Segment '%s' has a broken block at %d", name, seg.size)
+			}
+			if ss.readOnly {
+				return fmt.Errorf("Segment '%s' ends with %d bytes of a block that was cut off, probably by a crash, open the data dir for writing to remove them", name, size-seg.size)
+			}
+			fmt.Printf("WARNING: Segment '%s' ends with %d bytes of a block that was cut off, probably by a crash, they have been removed\n", name, size-seg.size)
+			if err := f.Truncate(seg.size); err != nil {
+				return fmt.Errorf("Cannot remove the partial block: %w", err)
+			}
+			return f.Sync()
+		}
+
+		ss.add(hash, blockLocation{len(ss.segments) - 1, seg.size})
+		seg.size = next
+	}
+
+	return nil
+}
+
+func (ss *segmentStore) Kind() StoreKind {
+	return StoreSegmented
+}
+
+func (ss *segmentStore) Len() uint64 {
+	return uint64(len(ss.hashes))
+}
+
+func (ss *segmentStore) Append(blockFs BlockFS) error {
+	if len(ss.segments) == 0 || ss.segments[len(ss.segments)-1].size >= segmentMaxSize {
+		err := ss.startSegment()
+		if err != nil {
+			return err
+		}
+	}
+	seg := ss.segments[len(ss.segments)-1]
+
+	encoded := encodeBlockFs(blockFs)
+	record := make([]byte, segmentRecordHeaderSize, segmentRecordHeaderSize+len(encoded))
+	binary.BigEndian.PutUint32(record, uint32(len(encoded)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(encoded))
+	record = append(record, encoded...)
+
+	_, err := seg.f.WriteAt(record, seg.size)
+	if err == nil {
+		err = syncFile(seg.f, ss.syncPolicy)
+	}
+	if err != nil {
+		// Don't leave part of the block for the next block to be appended to
+		if truncErr := seg.f.Truncate(seg.size); truncErr != nil {
+			fmt.Printf("WARNING: Cannot remove the partial block: %s\n", truncErr)
+		}
+		return fmt.Errorf("Cannot append block %d to segment '%s': %w", blockFs.Value.Header.BlockNumber, getSegmentFileName(seg.first), err)
+	}
+
+	ss.add(blockFs.Key, blockLocation{len(ss.segments) - 1, seg.size})
+	seg.size += int64(len(record))
+
+	return nil
+}
+
+// Start a new segment for the blocks from the next height
+func (ss *segmentStore) startSegment() error {
+	first := ss.Len()
+	f, err := os.OpenFile(getSegmentFilePath(ss.dir, first), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("Cannot create segment '%s': %w", getSegmentFileName(first), err)
+	}
+	ss.segments = append(ss.segments, &segment{first, f, 0})
+
+	return syncDir(ss.dir, ss.syncPolicy)
+}
+
+func (ss *segmentStore) add(hash Hash, location blockLocation) {
+	ss.heights[hash] = uint64(len(ss.hashes))
+	ss.hashes = append(ss.hashes, hash)
+	ss.locations = append(ss.locations, location)
+}
+
+func (ss *segmentStore) GetByHeight(height uint64) (BlockFS, error) {
+	if height >= ss.Len() {
+		return BlockFS{}, fmt.Errorf("%w: height %d", ErrBlockNotFound, height)
+	}
+
+	location := ss.locations[height]
+	seg := ss.segments[location.segment]
+	encoded, err := readRecord(seg.f, location.offset)
+	if err != nil {
+		return BlockFS{}, fmt.Errorf("Cannot read block %d from segment '%s': %w", height, getSegmentFileName(seg.first), err)
+	}
+
+	return decodeBlockFs(encoded)
+}
+
+func (ss *segmentStore) GetByHash(hash Hash) (BlockFS, error) {
+	height, ok := ss.heights[hash]
+	if !ok {
+		return BlockFS{}, fmt.Errorf("%w: '%s'", ErrBlockNotFound, hash.Hex())
+	}
+
+	return ss.GetByHeight(height)
+}
+
+func (ss *segmentStore) Iterate(from uint64, fn func(BlockFS) error) error {
+	for height := from; height < ss.Len(); height++ {
+		blockFs, err := ss.GetByHeight(height)
+		if err != nil {
+			return err
+		}
+		if err := fn(blockFs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The segments after the one holding block length are removed and that one is cut back
+func (ss *segmentStore) Truncate(length uint64) error {
+	if length >= ss.Len() {
+		return nil
+	}
+
+	location := ss.locations[length]
+	for i := len(ss.segments) - 1; i > location.segment; i-- {
+		seg := ss.segments[i]
+		_ = seg.f.Close()
+		err := os.Remove(getSegmentFilePath(ss.dir, seg.first))
+		if err != nil {
+			return fmt.Errorf("Cannot remove segment '%s': %w", getSegmentFileName(seg.first), err)
+		}
+		ss.segments = ss.segments[:i]
+	}
+
+	seg := ss.segments[location.segment]
+	err := seg.f.Truncate(location.offset)
+	if err == nil {
+		err = syncFile(seg.f, ss.syncPolicy)
+	}
+	if err == nil {
+		err = syncDir(ss.dir, ss.syncPolicy)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot remove the blocks from block %d on: %w", length, err)
+	}
+	seg.size = location.offset
+
+	for _, hash := range ss.hashes[length:] {
+		delete(ss.heights, hash)
+	}
+	ss.hashes = ss.hashes[:length]
+	ss.locations = ss.locations[:length]
+
+	return nil
+}
+
+func (ss *segmentStore) SetSyncPolicy(policy SyncPolicy) {
+	ss.syncPolicy = policy
+}
+
+func (ss *segmentStore) Close() error {
+	for _, seg := range ss.segments {
+		err := seg.f.Close()
+		if err != nil {
+			return fmt.Errorf("Could not close segment '%s': %w", getSegmentFileName(seg.first), err)
+		}
+	}
+	return nil
+}
+
+// Read the length of the block in the record at the offset and the hash it starts with
+func readRecordStart(f *os.File, offset int64) (uint32, Hash, error) {
+	start := make([]byte, segmentRecordHeaderSize+len(Hash{}))
+	_, err := f.ReadAt(start, offset)
+	if err != nil {
+		return 0, Hash{}, err
+	}
+
+	var hash Hash
+	copy(hash[:], start[segmentRecordHeaderSize:])
+	return binary.BigEndian.Uint32(start), hash, nil
+}
+
+// Read the encoded block in the record at the offset, checking its checksum
+func readRecord(f *os.File, offset int64) ([]byte, error) {
+	header := make([]byte, segmentRecordHeaderSize)
+	_, err := f.ReadAt(header, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := make([]byte, binary.BigEndian.Uint32(header))
+	_, err = f.ReadAt(encoded, offset+segmentRecordHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(encoded) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, fmt.Errorf("the block at %d fails its checksum", offset)
+	}
+
+	return encoded, nil
+}
+
+// The heights of the first block of each segment in the directory, in order
+func listSegments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []uint64{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the segments: %w", err)
+	}
+
+	firsts := make([]uint64, 0, len(files))
+	for _, f := range files {
+		var first uint64
+		_, err := fmt.Sscanf(f.Name(), segmentFilePrefix+"%d"+segmentFileExt, &first)
+		if err != nil || f.Name() != getSegmentFileName(first) {
+			continue
+		}
+		firsts = append(firsts, first)
+	}
+	sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
+
+	return firsts, nil
+}
+
+func getSegmentFilePath(dir string, first uint64) string {
+	return filepath.Join(dir, getSegmentFileName(first))
+}
+
+func getSegmentFileName(first uint64) string {
+	return fmt.Sprintf("%s%012d%s", segmentFilePrefix, first, segmentFileExt)
+}
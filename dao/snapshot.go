@@ -0,0 +1,223 @@
+package dao
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// How many blocks between the snapshots written as blocks are added
+const snapshotInterval = 100
+
+// How many of the newest snapshots are kept
+const snapshotsKept = 3
+
+const snapshotFilePrefix = "snapshot-"
+const snapshotFileExt = ".json"
+
+// A snapshot is the state after a block, so loading the state only replays the blocks after it
+type snapshot struct {
+	Height        uint64             `json:"height"`
+	BlockHash     Hash               `json:"block_hash"`
+	Balances      Balances           `json:"balances"`
+	Nonces        map[Account]uint64 `json:"nonces"`
+	TotalWork     *big.Int           `json:"total_work"`
+	RecentHeaders []BlockHeader      `json:"recent_headers"` // Needed to retarget the difficulty and check the time of the next blocks
+}
+
+// Snapshot writes the current state to the data dir
+// It returns the block the snapshot was taken after
+func (s *State) Snapshot() (BlockFS, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return BlockFS{}, fmt.Errorf("Cannot take a snapshot: %w", ErrReadOnly)
+	}
+	if !s.hasGenesisBlock {
+		return BlockFS{}, fmt.Errorf("There are no blocks to take a snapshot of")
+	}
+	if s.blocks.Kind() == StoreMemory {
+		return BlockFS{}, fmt.Errorf("The blocks in a %s store can't be snapshotted as they're lost when the node stops", StoreMemory)
+	}
+
+	err := s.writeSnapshot()
+	if err != nil {
+		return BlockFS{}, err
+	}
+
+	return BlockFS{s.latestBlockHash, s.latestBlock}, nil
+}
+
+func (s *State) writeSnapshot() error {
+	snap := snapshot{
+		Height:        s.latestBlock.Header.BlockNumber,
+		BlockHash:     s.latestBlockHash,
+		Balances:      s.Balances,
+		Nonces:        s.nonces,
+		TotalWork:     s.totalWork,
+		RecentHeaders: s.recentHeaders,
+	}
+
+	snapJson, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("Cannot convert the snapshot to json: %w", err)
+	}
+
+	snapshotsDir := getSnapshotsDirPath(s.dataDir)
+	if err := os.MkdirAll(snapshotsDir, 0700); err != nil {
+		return fmt.Errorf("Error creating snapshot directory: %w", err)
+	}
+
+	snapFilePath := getSnapshotFilePath(s.dataDir, snap.Height)
+	err = writeFileAtomically(snapFilePath, snapJson, s.syncPolicy)
+	if err != nil {
+		return fmt.Errorf("Cannot write snapshot '%s': %w", snapFilePath, err)
+	}
+
+	// Only the newest snapshots are worth keeping
+	heights, err := listSnapshots(s.dataDir)
+	if err != nil {
+		return err
+	}
+	for i := snapshotsKept; i < len(heights); i++ {
+		_ = os.Remove(getSnapshotFilePath(s.dataDir, heights[i]))
+	}
+
+	return nil
+}
+
+// Remove the snapshots of blocks that are no longer in the chain, after a reorganisation
+func (s *State) removeStaleSnapshots() {
+	heights, err := listSnapshots(s.dataDir)
+	if err != nil {
+		fmt.Printf("WARNING: %s\n", err)
+		return
+	}
+
+	for _, height := range heights {
+		snap, err := readSnapshot(s.dataDir, height)
+		if err != nil || !s.hasBlock(height, snap.BlockHash) {
+			_ = os.Remove(getSnapshotFilePath(s.dataDir, height))
+		}
+	}
+}
+
+// Restore the state from the newest snapshot of a block in the stored chain
+// It returns false when there's no usable snapshot and the state is left as it was
+func (s *State) restoreLatestSnapshot() bool {
+	return s.restoreSnapshotUpTo(math.MaxUint64)
+}
+
+// Restore the state from the newest snapshot of a block in the stored chain at or before the height
+func (s *State) restoreSnapshotUpTo(maxHeight uint64) bool {
+	heights, err := listSnapshots(s.dataDir)
+	if err != nil {
+		fmt.Printf("WARNING: %s\n", err)
+		return false
+	}
+
+	for _, height := range heights {
+		if height > maxHeight {
+			continue
+		}
+		snap, err := readSnapshot(s.dataDir, height)
+		if err != nil {
+			fmt.Printf("WARNING: Ignoring snapshot of block %d: %s\n", height, err)
+			continue
+		}
+		blockFs, err := s.blocks.GetByHeight(height)
+		if errors.Is(err, ErrBlockNotFound) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("WARNING: Ignoring snapshot of block %d: %s\n", height, err)
+			continue
+		}
+		if blockFs.Key != snap.BlockHash {
+			continue
+		}
+
+		s.Balances = snap.Balances
+		s.nonces = snap.Nonces
+		s.totalWork = snap.TotalWork
+		s.recentHeaders = snap.RecentHeaders
+		s.latestBlock = blockFs.Value
+		s.latestBlockHash = blockFs.Key
+		s.hasGenesisBlock = true
+
+		return true
+	}
+
+	return false
+}
+
+// Is the block with the hash at the height in the stored chain
+func (s *State) hasBlock(height uint64, hash Hash) bool {
+	blockFs, err := s.blocks.GetByHeight(height)
+	return err == nil && blockFs.Key == hash
+}
+
+func readSnapshot(dataDir string, height uint64) (snapshot, error) {
+	content, err := ioutil.ReadFile(getSnapshotFilePath(dataDir, height))
+	if err != nil {
+		return snapshot{}, err
+	}
+
+	var snap snapshot
+	err = json.Unmarshal(content, &snap)
+	if err != nil {
+		return snapshot{}, fmt.Errorf("Cannot interpret json: %w", err)
+	}
+
+	// The snapshot must be complete and its latest header must be its block
+	if snap.Height != height || snap.Balances == nil || snap.TotalWork == nil || len(snap.RecentHeaders) == 0 {
+		return snapshot{}, fmt.Errorf("the snapshot is incomplete")
+	}
+	if snap.RecentHeaders[len(snap.RecentHeaders)-1].Hash() != snap.BlockHash {
+		return snapshot{}, fmt.Errorf("the latest header isn't block '%s'", snap.BlockHash.Hex())
+	}
+	if snap.Nonces == nil {
+		snap.Nonces = make(map[Account]uint64)
+	}
+
+	return snap, nil
+}
+
+// The heights of the snapshots in the data dir, newest first
+func listSnapshots(dataDir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(getSnapshotsDirPath(dataDir))
+	if os.IsNotExist(err) {
+		return []uint64{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the snapshots: %w", err)
+	}
+
+	heights := make([]uint64, 0, len(files))
+	for _, f := range files {
+		var height uint64
+		_, err := fmt.Sscanf(f.Name(), snapshotFilePrefix+"%d"+snapshotFileExt, &height)
+		if err != nil || f.Name() != getSnapshotFileName(height) {
+			continue
+		}
+		heights = append(heights, height)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+
+	return heights, nil
+}
+
+func getSnapshotFilePath(dataDir string, height uint64) string {
+	return filepath.Join(getSnapshotsDirPath(dataDir), getSnapshotFileName(height))
+}
+
+func getSnapshotFileName(height uint64) string {
+	return fmt.Sprintf("%s%d%s", snapshotFilePrefix, height, snapshotFileExt)
+}
@@ -0,0 +1,107 @@
+package dao
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestLoadStateFromTheLatestSnapshot(t *testing.T) {
+	s, hashes := newTestChainOnDisk(t, 3)
+	if _, err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := s.AddBlock(mineTestBlock(t, s, babayaga.account, []SignedTx{andrej.signTx(caesar.account, 0, 10, 0, "")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Doctor the snapshot to show that it was used rather than replaying from genesis
+	snap, err := readSnapshot(s.dataDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Balances[andrej.account] += 1000
+	snapJson, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(getSnapshotFilePath(s.dataDir, 2), snapJson, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadStateFromDisk(s.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+
+	if reloaded.LatestBlockHash() != hash {
+		t.Errorf("latest block is '%s'; want '%s'", reloaded.LatestBlockHash().Hex(), hash.Hex())
+	}
+	want := Balances{andrej.account: 1390, babayaga.account: DefaultBlockReward, caesar.account: 10}
+	if !reflect.DeepEqual(reloaded.Balances, want) {
+		t.Errorf("got balances %v; want %v", reloaded.Balances, want)
+	}
+	if got := reloaded.NextNonce(andrej.account); got != 1 {
+		t.Errorf("got nonce %d; want 1", got)
+	}
+	if reloaded.TotalWork().Cmp(s.TotalWork()) != 0 || reloaded.NextDifficulty() != s.NextDifficulty() {
+		t.Errorf("got work %s and difficulty %d; want %s and %d", reloaded.TotalWork(), reloaded.NextDifficulty(), s.TotalWork(), s.NextDifficulty())
+	}
+	block, err := GetBlockByHeight(2, reloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Key != hashes[2] {
+		t.Errorf("got block '%s' at height 2; want '%s'", block.Key.Hex(), hashes[2].Hex())
+	}
+}
+
+func TestSnapshotsOfOtherChainsAreIgnored(t *testing.T) {
+	s, _ := newTestChainOnDisk(t, 2)
+	if _, err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A snapshot of a block that isn't in the chain
+	other, _ := newTestChainOnDisk(t, 0)
+	defer other.Close()
+	addTestBlocks(t, other, caesar.account, []SignedTx{}, []SignedTx{})
+	if _, err := other.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	snapJson, err := ioutil.ReadFile(getSnapshotFilePath(other.dataDir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(snapJson, &snap); err != nil {
+		t.Fatal(err)
+	}
+	snap.Balances[andrej.account] += 1000
+	snapJson, err = json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(getSnapshotFilePath(s.dataDir, 1), snapJson, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadStateFromDisk(s.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+
+	if !reflect.DeepEqual(reloaded.Balances, s.Balances) {
+		t.Errorf("got balances %v; want %v", reloaded.Balances, s.Balances)
+	}
+}
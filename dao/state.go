@@ -1,47 +1,244 @@
 package dao
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
 	"os"
 	"reflect"
+	"sort"
+	"sync"
+	"time"
 )
 
+// How many of the latest blocks the time of the next block is compared with
+const medianTimeBlocks = 11
+
 type Balances map[Account]uint
 
 type State struct {
-	Balances  Balances // The current balances
-	txMempool []Tx     // The transactions that are executed but not in the tx.dao file
+	Balances  Balances           // The current balances
+	nonces    map[Account]uint64 // How many transactions each account has sent
+	txMempool []SignedTx         // The transactions waiting to be mined into a block
+	mu        sync.Mutex
+
+	dataDir  string
+	lock     *dataDirLock // Keeps other processes from writing to the data dir
+	readOnly bool         // The data dir is only read, blocks can't be added
+	blocks   BlockStore   // The blocks of the chain
+	txs      *txIndex     // Where each transaction, and those of each account, are in the chain
 
-	dataDir     string
-	blockDbFile *os.File // The handler to the transaction file
+	syncPolicy SyncPolicy // When the snapshots are flushed to the disk
 
+	genesisHash     Hash  // The parent of block 0
 	latestBlock     Block // The latest block
 	latestBlockHash Hash  // Hash code associated with the current block
 	hasGenesisBlock bool
+	totalWork       *big.Int // The work done to mine every block in the chain
+
+	difficulty       uint32        // The difficulty of the first blocks
+	retargetInterval uint64        // How many blocks between difficulty changes
+	blockTime        uint64        // The target number of seconds between blocks
+	blockReward      uint          // The most a miner can reward themselves for a block
+	maxTimeDrift     uint64        // How many seconds a block can be ahead of our clock
+	minFee           uint          // The least a transaction must pay the miner
+	recentHeaders    []BlockHeader // The latest headers, enough to retarget the difficulty and check times
+
+	now func() time.Time // The clock blocks are checked against
 }
 
 func (s *State) LatestBlock() Block {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	return s.latestBlock
 }
 
 func (s *State) LatestBlockHash() Hash {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.latestBlockHash
+}
+
+// GenesisHash identifies the genesis the chain started from
+func (s *State) GenesisHash() Hash {
+	return s.genesisHash
+}
+
+// NextParentHash is the parent of the next block, the genesis hash for block 0
+func (s *State) NextParentHash() Hash {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nextParentHash()
+}
+
+func (s *State) nextParentHash() Hash {
+	if !s.hasGenesisBlock {
+		return s.genesisHash
+	}
 	return s.latestBlockHash
 }
 
+// TotalWork is the amount of work it took to mine the whole chain
+// The chain with the most work is the one every node follows
+func (s *State) TotalWork() *big.Int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return new(big.Int).Set(s.totalWork)
+}
+
+// ChainTip is the latest block and everything the next block is built from, as it was at one moment
+type ChainTip struct {
+	Latest     BlockFS  // The latest block, empty before block 0
+	TotalWork  *big.Int // The work done to mine every block up to the latest
+	Parent     Hash
+	Number     uint64
+	Difficulty uint32
+	MedianTime uint64 // The next block must be later than this
+	Reward     uint   // The most the miner can reward themselves
+}
+
+// Tip reads the latest block and what the next block is built on under one lock
+// Reading each part separately could mix two tips when a block is added in between.
+func (s *State) Tip() ChainTip {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return ChainTip{
+		Latest:     BlockFS{s.latestBlockHash, s.latestBlock},
+		TotalWork:  new(big.Int).Set(s.totalWork),
+		Parent:     s.nextParentHash(),
+		Number:     s.nextBlockNumber(),
+		Difficulty: s.nextDifficulty(),
+		MedianTime: s.medianTime(),
+		Reward:     s.blockReward,
+	}
+}
+
+// SetClock replaces the clock that block times are checked against
+func (s *State) SetClock(now func() time.Time) {
+	s.now = now
+}
+
 func (s *State) DataDir() string {
 	return s.dataDir
 }
 
+// LoadStateFromDisk loads the state from whichever block store holds the blocks in the data dir
 func LoadStateFromDisk(dataDir string) (*State, error) {
-	err := initDataDirIfNotExists(dataDir)
+	return LoadStateWithStore(dataDir, "")
+}
+
+// LoadStateWithStore loads the state from the kind of block store
+// An empty kind is whichever store already holds the blocks, or json for a new data dir.
+// The data dir is locked until the state is closed, so no other process can open it.
+func LoadStateWithStore(dataDir string, kind StoreKind) (*State, error) {
+	return loadLockedState(dataDir, kind, false)
+}
+
+// LoadStateReadOnly loads the state to inspect it without changing the data dir
+// Other read only states can share the data dir, but not a process that writes to it.
+func LoadStateReadOnly(dataDir string) (*State, error) {
+	return loadLockedState(dataDir, "", true)
+}
+
+// Lock the data dir before anything in it is read or created
+// The genesis file must already be there, nothing is created in a data dir without one.
+func loadLockedState(dataDir string, kind StoreKind, readOnly bool) (*State, error) {
+	if !fileExist(GetGenesisJsonFilePath(dataDir)) {
+		return nil, fmt.Errorf("The data dir '%s' has no genesis file, 'tbb genesis init' writes one to start a new chain", dataDir)
+	}
+
+	err := os.MkdirAll(dataDir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating data directory: %w", err)
+	}
+
+	lock, err := lockDataDir(dataDir, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := loadState(dataDir, kind, readOnly)
+	if err != nil {
+		_ = lock.release()
+		return nil, err
+	}
+	state.lock = lock
+
+	return state, nil
+}
+
+func loadState(dataDir string, kind StoreKind, readOnly bool) (*State, error) {
+	if !readOnly {
+		err := initDataDirIfNotExists(dataDir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to initialise the data: %w", err)
+		}
+	}
+
+	state, err := newGenesisState(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	state.readOnly = readOnly
+	state.blocks, err = openBlockStore(dataDir, kind, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	err = state.checkGenesis()
+	if err != nil {
+		state.blocks.Close()
+		return nil, err
+	}
+
+	// Start from the newest snapshot so only the blocks after it are replayed
+	from := uint64(0)
+	if state.restoreLatestSnapshot() {
+		from = state.latestBlock.Header.BlockNumber + 1
+	}
+
+	err = state.blocks.Iterate(from, state.applyBlockFs)
+	if err != nil {
+		state.blocks.Close()
+		return nil, err
+	}
+
+	state.txs, err = loadTxIndex(dataDir, state.blocks, readOnly)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to initialise the data: %w", err)
+		state.blocks.Close()
+		return nil, err
 	}
 
+	return state, nil
+}
+
+// Refuse blocks that started from a different genesis file
+func (s *State) checkGenesis() error {
+	first, err := s.blocks.GetByHeight(0)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if first.Value.Header.Parent != s.genesisHash {
+		return fmt.Errorf("The blocks in the data dir don't belong to its genesis file, block 0 follows '%s' not the genesis hash '%s'", first.Value.Header.Parent.Hex(), s.genesisHash.Hex())
+	}
+	return nil
+}
+
+// The state before any blocks have been applied
+func newGenesisState(dataDir string) (*State, error) {
 	// Load the genesis file
-	gen, err := loadGenesis(getGenesisJsonFilePath(dataDir))
+	gen, err := loadGenesis(GetGenesisJsonFilePath(dataDir))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load the genesis file: %w", err)
 	}
@@ -52,56 +249,62 @@ func LoadStateFromDisk(dataDir string) (*State, error) {
 		balances[account] = balance
 	}
 
-	// Now open the file for append as well as read
-	blockDbFile, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_APPEND|os.O_RDWR, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot open block file: %w", err)
-	}
-
 	// Create the baseline state
-	state := &State{Balances: balances,
-		txMempool:       make([]Tx, 0),
+	return &State{Balances: balances,
+		nonces:          make(map[Account]uint64),
+		txMempool:       make([]SignedTx, 0),
 		dataDir:         dataDir,
-		blockDbFile:     blockDbFile,
+		syncPolicy:      SyncAlways,
+		genesisHash:     gen.Hash(),
 		latestBlock:     Block{},
 		latestBlockHash: Hash{},
-		hasGenesisBlock: false}
-
-	// Read each line separately - each line is a transaction
-	scanner := bufio.NewScanner(blockDbFile)
-
-	// Iterate over each the existing transactions in the tx.dao file
-	// Surely everything is in the last line being the last block?
-	//var blockFs BlockFS
-	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			return nil, fmt.Errorf("Cannot read line from block: %w", err)
-		}
+		hasGenesisBlock: false,
+		totalWork:       big.NewInt(0),
+
+		difficulty:       gen.Difficulty,
+		retargetInterval: gen.RetargetInterval,
+		blockTime:        gen.BlockTime,
+		blockReward:      gen.BlockReward,
+		maxTimeDrift:     gen.MaxTimeDrift,
+		minFee:           gen.MinFee,
+		recentHeaders:    make([]BlockHeader, 0),
+
+		now: time.Now,
+	}, nil
+}
 
-		// Read next json message within the block
-		blockFsJson := scanner.Bytes()
-		var blockFs BlockFS
-		err = json.Unmarshal(blockFsJson, &blockFs)
-		if err != nil {
-			return nil, fmt.Errorf("Cannot interpret json %v: %w", blockFsJson, err)
-		}
+// Apply a block read back from the block store
+func (s *State) applyBlockFs(blockFs BlockFS) error {
+	// Make sure the block hasn't been tampered with since it was written
+	blockHash := blockFs.Value.Hash()
+	if blockHash != blockFs.Key {
+		return fmt.Errorf("Block %d is stored with hash '%s' but hashes to '%s'", blockFs.Value.Header.BlockNumber, blockFs.Key.Hex(), blockHash.Hex())
+	}
 
-		err = state.applyBlock(blockFs.Value)
-		if err != nil {
-			return nil, fmt.Errorf("Cannot apply block %v: %w", blockFs.Value, err)
-		}
-		// Now we update the state with the hash of the last block
-		state.latestBlock = blockFs.Value
-		state.latestBlockHash = blockFs.Key
-		state.hasGenesisBlock = true
+	err := s.applyBlock(blockFs.Value)
+	if err != nil {
+		return fmt.Errorf("Cannot apply block %v: %w", blockFs.Value, err)
 	}
 
-	return state, nil
+	// Now we update the state with the hash of the last block
+	s.rememberHeader(blockFs.Value.Header)
+	s.latestBlock = blockFs.Value
+	s.latestBlockHash = blockFs.Key
+	s.hasGenesisBlock = true
+
+	return nil
 }
 
 func (s *State) AddBlocks(blocks []Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addBlocks(blocks)
+}
+
+func (s *State) addBlocks(blocks []Block) error {
 	for _, b := range blocks {
-		_, err := s.AddBlock(b)
+		_, err := s.addBlock(b)
 		if err != nil {
 			return fmt.Errorf("Could not add blocks %v: %w", b, err)
 		}
@@ -110,11 +313,20 @@ func (s *State) AddBlocks(blocks []Block) error {
 	return nil
 }
 
-// This iterates through each transaction within the block
-// and adds each tx using AddTx
-//// This saves the latest state of the block chain
-//// It then takes the whole file and generates a hash
+// This applies each transaction within the block and then appends the block
+// to the block store. Any transactions in the block are removed from the mempool.
 func (s *State) AddBlock(b Block) (Hash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addBlock(b)
+}
+
+func (s *State) addBlock(b Block) (Hash, error) {
+	if s.readOnly {
+		return Hash{}, fmt.Errorf("Cannot add block %d: %w", b.Header.BlockNumber, ErrReadOnly)
+	}
+
 	pendingState := s.copy()
 
 	err := pendingState.applyBlock(b)
@@ -122,11 +334,7 @@ func (s *State) AddBlock(b Block) (Hash, error) {
 		return Hash{}, fmt.Errorf("Cannot apply block %v: %w", b, err)
 	}
 
-	blockHash, err := b.Hash()
-	if err != nil {
-		return Hash{}, fmt.Errorf("Cannot hash block %v: %w", b, err)
-	}
-
+	blockHash := b.Hash()
 	blockFs := BlockFS{blockHash, b}
 
 	blockFsJson, err := json.Marshal(blockFs)
@@ -134,33 +342,282 @@ func (s *State) AddBlock(b Block) (Hash, error) {
 		return Hash{}, fmt.Errorf("Cannot convert to json %v: %w", blockFs.Value, err)
 	}
 
-	fmt.Printf("Persisting new Block to disk:\n")
+	fmt.Printf("Persisting new Block to the %s block store:\n", s.blocks.Kind())
 	fmt.Printf("\t%s\n", blockFsJson)
 
-	_, err = s.blockDbFile.Write(append(blockFsJson, '\n'))
+	err = s.blocks.Append(blockFs)
 	if err != nil {
-		return Hash{}, fmt.Errorf("Cannot append json to file %v: %w", blockFsJson, err)
+		return Hash{}, err
 	}
+	warnIndexRebuilt(s.txs.append(blockFs))
 
 	s.Balances = pendingState.Balances
+	s.nonces = pendingState.nonces
+	s.totalWork = pendingState.totalWork
+	s.rememberHeader(b.Header)
 	s.latestBlockHash = blockHash
 	s.latestBlock = b
 	s.hasGenesisBlock = true
+	s.removeMinedTXs(b.TXs)
+
+	if b.Header.BlockNumber%snapshotInterval == 0 && b.Header.BlockNumber > 0 && s.blocks.Kind() != StoreMemory {
+		err = s.writeSnapshot()
+		if err != nil {
+			fmt.Printf("WARNING: Cannot take a snapshot of block %d: %s\n", b.Header.BlockNumber, err)
+		}
+	}
 
 	return blockHash, nil
 }
 
+// BlockReward is the most a miner can reward themselves for mining a block
+func (s *State) BlockReward() uint {
+	return s.blockReward
+}
+
+// AddBranch adds the blocks that follow the forkPoint block
+//
+// When the forkPoint is the latest block the blocks simply extend the chain.
+// Otherwise the blocks are a competing branch and the chain is reorganised onto
+// them when they have more work than the blocks they replace.
+func (s *State) AddBranch(forkPoint Hash, blocks []Block) error {
+	// Decide under the same lock the blocks are added with, so a block mined in
+	// the meantime can't make the branch extend the chain from the wrong block
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if forkPoint == s.latestBlockHash {
+		return s.addBlocks(blocks)
+	}
+
+	return s.reorganise(forkPoint, blocks)
+}
+
+// Roll the balances back to the forkPoint block and then apply the competing branch
+// The transactions in the replaced blocks go back into the mempool
+func (s *State) reorganise(forkPoint Hash, blocks []Block) error {
+	if s.readOnly {
+		return fmt.Errorf("Cannot replace the blocks after '%s': %w", forkPoint.Hex(), ErrReadOnly)
+	}
+
+	forkState, keptLength, displacedBlocks, err := s.replayUntil(forkPoint)
+	if err != nil {
+		return fmt.Errorf("Cannot roll back to block '%s': %w", forkPoint.Hex(), err)
+	}
+
+	// Check the whole branch before any blocks are replaced
+	branchState := forkState.copy()
+	branchBlocks := make([]BlockFS, 0, len(blocks))
+	for _, b := range blocks {
+		blockFs := BlockFS{b.Hash(), b}
+		if err := branchState.applyBlockFs(blockFs); err != nil {
+			return err
+		}
+		branchBlocks = append(branchBlocks, blockFs)
+	}
+
+	if branchState.totalWork.Cmp(s.totalWork) <= 0 {
+		return fmt.Errorf("the branch from block '%s' has no more work than the current chain", forkPoint.Hex())
+	}
+
+	err = s.blocks.Truncate(keptLength)
+	if err != nil {
+		return err
+	}
+	warnIndexRebuilt(s.txs.truncate(keptLength))
+	s.removeStaleSnapshots()
+
+	// The state follows the blocks that made it into the store, so it still
+	// matches the store if appending the branch fails part way
+	addedBlocks := make([]Block, 0, len(branchBlocks))
+	for _, blockFs := range branchBlocks {
+		err = s.blocks.Append(blockFs)
+		if err != nil {
+			break
+		}
+		warnIndexRebuilt(s.txs.append(blockFs))
+		if err = forkState.applyBlockFs(blockFs); err != nil {
+			break
+		}
+		addedBlocks = append(addedBlocks, blockFs.Value)
+	}
+
+	fmt.Printf("Reorganised the chain at block '%s', %d blocks replaced by %d blocks\n", forkPoint.Hex(), len(displacedBlocks), len(addedBlocks))
+
+	s.Balances = forkState.Balances
+	s.nonces = forkState.nonces
+	s.latestBlock = forkState.latestBlock
+	s.latestBlockHash = forkState.latestBlockHash
+	s.hasGenesisBlock = forkState.hasGenesisBlock
+	s.totalWork = forkState.totalWork
+	s.recentHeaders = forkState.recentHeaders
+
+	// Everything except the coinbase is waiting to be mined again
+	displacedTXs := make([]SignedTx, 0)
+	for _, b := range displacedBlocks {
+		if len(b.TXs) > 0 {
+			displacedTXs = append(displacedTXs, b.TXs[1:]...)
+		}
+	}
+	s.txMempool = append(displacedTXs, s.txMempool...)
+
+	branchTXs := make([]SignedTx, 0)
+	for _, b := range addedBlocks {
+		branchTXs = append(branchTXs, b.TXs...)
+	}
+	s.removeMinedTXs(branchTXs)
+
+	if err != nil {
+		return fmt.Errorf("Cannot add the branch from block '%s': %w", forkPoint.Hex(), err)
+	}
+
+	return nil
+}
+
+// Replay the blocks into a new state up to and including the forkPoint block
+// An empty forkPoint is the state before any blocks. It returns how many blocks are
+// kept, up to the forkPoint, and the blocks after it which are displaced.
+func (s *State) replayUntil(forkPoint Hash) (*State, uint64, []Block, error) {
+	forkState, err := newGenesisState(s.dataDir)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	forkState.now = s.now
+
+	keptLength := uint64(0)
+	if !forkPoint.IsEmpty() {
+		forkBlock, err := s.blocks.GetByHash(forkPoint)
+		if errors.Is(err, ErrBlockNotFound) {
+			return nil, 0, nil, fmt.Errorf("block '%s' is not in the chain", forkPoint.Hex())
+		}
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		keptLength = forkBlock.Value.Header.BlockNumber + 1
+	}
+
+	displacedBlocks := make([]Block, 0)
+	err = s.blocks.Iterate(0, func(blockFs BlockFS) error {
+		if blockFs.Value.Header.BlockNumber < keptLength {
+			return forkState.applyBlockFs(blockFs)
+		}
+		displacedBlocks = append(displacedBlocks, blockFs.Value)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return forkState, keptLength, displacedBlocks, nil
+}
+
 func (s *State) NextBlockNumber() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nextBlockNumber()
+}
+
+func (s *State) nextBlockNumber() uint64 {
 	if !s.hasGenesisBlock {
 		return uint64(0)
 	}
 
-	return s.LatestBlock().Header.BlockNumber + 1
+	return s.latestBlock.Header.BlockNumber + 1
+}
+
+// NextDifficulty is the difficulty the next block must be mined at
+//
+// Every retargetInterval blocks the time taken to mine the previous blocks is compared
+// with the target block time. Each bit of difficulty doubles the work so the difficulty
+// goes up a bit when blocks are twice as fast as they should be and down a bit when
+// they are twice as slow.
+func (s *State) NextDifficulty() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nextDifficulty()
 }
 
-// This applies a transaction and then remembers it in the memory pool
-func (s *State) AddTx(tx Tx) error {
-	if err := s.applyTx(tx); err != nil {
+func (s *State) nextDifficulty() uint32 {
+	if !s.hasGenesisBlock {
+		return s.difficulty
+	}
+
+	difficulty := s.latestBlock.Header.Difficulty
+	if s.nextBlockNumber()%s.retargetInterval != 0 || uint64(len(s.recentHeaders)) < s.retargetInterval {
+		return difficulty
+	}
+
+	first := s.recentHeaders[uint64(len(s.recentHeaders))-s.retargetInterval]
+	last := s.recentHeaders[len(s.recentHeaders)-1]
+	expected := (s.retargetInterval - 1) * s.blockTime
+	actual := uint64(0)
+	if last.Time > first.Time {
+		actual = last.Time - first.Time
+	}
+
+	switch {
+	case actual < expected/2:
+		difficulty++
+	case actual > expected*2 && difficulty > 1:
+		difficulty--
+	}
+
+	return difficulty
+}
+
+// MedianTime is the median time of the latest blocks
+// The next block has to be later than this
+func (s *State) MedianTime() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.medianTime()
+}
+
+func (s *State) medianTime() uint64 {
+	count := len(s.recentHeaders)
+	if count > medianTimeBlocks {
+		count = medianTimeBlocks
+	}
+	if count == 0 {
+		return 0
+	}
+
+	times := make([]uint64, 0, count)
+	for _, h := range s.recentHeaders[len(s.recentHeaders)-count:] {
+		times = append(times, h.Time)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	return times[count/2]
+}
+
+// Keep hold of the latest headers so the difficulty can be retargeted
+// and the time of the next block checked
+func (s *State) rememberHeader(h BlockHeader) {
+	keep := s.retargetInterval
+	if keep < medianTimeBlocks {
+		keep = medianTimeBlocks
+	}
+	if uint64(len(s.recentHeaders)) >= keep {
+		s.recentHeaders = s.recentHeaders[1:]
+	}
+	s.recentHeaders = append(s.recentHeaders, h)
+}
+
+// AddTx checks the transaction can be applied on top of the mempool
+// and then remembers it in the mempool until it is mined
+func (s *State) AddTx(tx SignedTx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pendingState := s.copy()
+	if err := pendingState.applyTXs(pendingState.txMempool); err != nil {
+		return fmt.Errorf("Cannot apply the mempool: %w", err)
+	}
+	if err := pendingState.applyTx(tx); err != nil {
 		return err
 	}
 	s.txMempool = append(s.txMempool, tx)
@@ -168,12 +625,124 @@ func (s *State) AddTx(tx Tx) error {
 	return nil
 }
 
+// NextNonce is the nonce the next transaction from the account must have
+// Transactions still waiting in the mempool are counted as already sent
+func (s *State) NextNonce(account Account) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nonce := s.nonces[account]
+	for _, tx := range s.txMempool {
+		if tx.From == account {
+			nonce++
+		}
+	}
+
+	return nonce
+}
+
+// PendingTx finds a transaction in the mempool by its hash
+func (s *State) PendingTx(txHash Hash) (SignedTx, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, tx := range s.txMempool {
+		if tx.Hash() == txHash {
+			return tx, true
+		}
+	}
+
+	return SignedTx{}, false
+}
+
+// MinFee is the least a transaction must pay the miner
+func (s *State) MinFee() uint {
+	return s.minFee
+}
+
+// PendingTXs are the transactions in the mempool in the order they should be mined
+//
+// The transactions paying the highest fees come first, but each account's transactions
+// must stay in nonce order so a high fee can't jump ahead of an earlier transaction.
+// Ties go to whichever transaction reached the mempool first. A transaction can depend
+// on tokens sent by a cheaper one, so each one is only taken once it can be applied.
+func (s *State) PendingTXs() []SignedTx {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Queue up each account's transactions in the order they were added, which is nonce order
+	queues := make(map[Account][]int)
+	for i, tx := range s.txMempool {
+		queues[tx.From] = append(queues[tx.From], i)
+	}
+
+	pendingState := s.copy()
+	pendingTXs := make([]SignedTx, 0, len(s.txMempool))
+	for {
+		// The next transaction of every account, best paying first
+		next := make([]int, 0, len(queues))
+		for _, queue := range queues {
+			if len(queue) > 0 {
+				next = append(next, queue[0])
+			}
+		}
+		sort.Slice(next, func(a, b int) bool {
+			txA, txB := s.txMempool[next[a]], s.txMempool[next[b]]
+			if txA.Fee != txB.Fee {
+				return txA.Fee > txB.Fee
+			}
+			return next[a] < next[b]
+		})
+
+		applied := false
+		for _, i := range next {
+			tx := s.txMempool[i]
+			if pendingState.applyTx(tx) == nil {
+				pendingTXs = append(pendingTXs, tx)
+				queues[tx.From] = queues[tx.From][1:]
+				applied = true
+				break
+			}
+		}
+		if !applied {
+			break
+		}
+	}
+
+	return pendingTXs
+}
+
+// Once a block is added its transactions are no longer pending
+// The block might have come from a peer so anything left in the
+// mempool that is no longer valid is dropped as well
+func (s *State) removeMinedTXs(minedTXs []SignedTx) {
+	mined := make(map[Hash]bool)
+	for _, tx := range minedTXs {
+		mined[tx.Hash()] = true
+	}
+
+	pendingState := s.copy()
+	txMempool := make([]SignedTx, 0, len(s.txMempool))
+	for _, tx := range s.txMempool {
+		if mined[tx.Hash()] {
+			continue
+		}
+		if err := pendingState.applyTx(tx); err != nil {
+			fmt.Printf("Dropping pending TX %v: %s\n", tx, err)
+			continue
+		}
+		txMempool = append(txMempool, tx)
+	}
+	s.txMempool = txMempool
+}
+
+// Close the blocks and then release the data dir for other processes
 func (s *State) Close() error {
-	err := s.blockDbFile.Close()
-	if err != nil {
-		return fmt.Errorf("Could not close the block file: %w", err)
+	err := s.blocks.Close()
+	if lockErr := s.lock.release(); err == nil {
+		err = lockErr
 	}
-	return nil
+	return err
 }
 
 // applyBlock verifies if block can be added to the blockchain.
@@ -186,14 +755,89 @@ func (s *State) applyBlock(b Block) error {
 		return fmt.Errorf("next expected block must be '%d' not '%d'", nextExpectedBlockNumber, b.Header.BlockNumber)
 	}
 
-	if s.hasGenesisBlock && s.latestBlock.Header.BlockNumber > 0 && !reflect.DeepEqual(b.Header.Parent, s.latestBlockHash) {
+	if s.hasGenesisBlock && !reflect.DeepEqual(b.Header.Parent, s.latestBlockHash) {
 		return fmt.Errorf("next block parent hash must be '%x' not '%x'", s.latestBlockHash, b.Header.Parent)
 	}
 
-	return s.applyTXs(b.TXs)
+	if !s.hasGenesisBlock && b.Header.BlockNumber != 0 {
+		return fmt.Errorf("the first block must be '0' not '%d'", b.Header.BlockNumber)
+	}
+
+	if !s.hasGenesisBlock && b.Header.Parent != s.genesisHash {
+		return fmt.Errorf("block 0 parent hash must be the genesis hash '%x' not '%x', it belongs to another chain", s.genesisHash, b.Header.Parent)
+	}
+
+	hash := b.Hash()
+
+	if s.hasGenesisBlock && b.Header.Time <= s.medianTime() {
+		return fmt.Errorf("block %d '%s' has the time %d which must be after %d, the median of the latest blocks", b.Header.BlockNumber, hash.Hex(), b.Header.Time, s.medianTime())
+	}
+
+	latestTime := uint64(s.now().Unix()) + s.maxTimeDrift
+	if b.Header.Time > latestTime {
+		return fmt.Errorf("block %d '%s' has the time %d which is more than %d seconds in the future", b.Header.BlockNumber, hash.Hex(), b.Header.Time, s.maxTimeDrift)
+	}
+
+	txRoot := MerkleRoot(b.TXs)
+	if b.Header.TxRoot != txRoot {
+		return fmt.Errorf("block %d '%s' has the transaction root '%s' but the transactions hash to '%s'", b.Header.BlockNumber, hash.Hex(), b.Header.TxRoot.Hex(), txRoot.Hex())
+	}
+
+	nextDifficulty := s.nextDifficulty()
+	if b.Header.Difficulty != nextDifficulty {
+		return fmt.Errorf("block %d '%s' must have difficulty %d not %d", b.Header.BlockNumber, hash.Hex(), nextDifficulty, b.Header.Difficulty)
+	}
+
+	if !IsBlockHashValid(hash, b.Header.Difficulty) {
+		return fmt.Errorf("block %d has an invalid proof-of-work hash '%s'", b.Header.BlockNumber, hash.Hex())
+	}
+
+	err := s.applyCoinbase(b)
+	if err != nil {
+		return fmt.Errorf("block %d '%s' has an invalid coinbase: %w", b.Header.BlockNumber, hash.Hex(), err)
+	}
+
+	err = s.applyTXs(b.TXs[1:])
+	if err != nil {
+		return err
+	}
+
+	// The miner collects the fees on top of the reward
+	for _, tx := range b.TXs[1:] {
+		s.Balances[b.Header.Miner] += tx.Fee
+	}
+
+	s.totalWork.Add(s.totalWork, BlockWork(b.Header.Difficulty))
+
+	return nil
 }
 
-func (s *State) applyTXs(txs []Tx) error {
+// Every block starts with a single reward to the miner of the block
+func (s *State) applyCoinbase(b Block) error {
+	if len(b.TXs) == 0 || !b.TXs[0].IsReward() {
+		return fmt.Errorf("the first transaction must reward the miner")
+	}
+
+	coinbase := b.TXs[0]
+	if coinbase.From != "" {
+		return fmt.Errorf("the reward can't come from '%s'", coinbase.From)
+	}
+	if coinbase.To != b.Header.Miner {
+		return fmt.Errorf("the reward must go to the miner '%s' not '%s'", b.Header.Miner, coinbase.To)
+	}
+	if coinbase.Nonce != b.Header.BlockNumber {
+		return fmt.Errorf("the reward must have the block number %d as its nonce not %d", b.Header.BlockNumber, coinbase.Nonce)
+	}
+	if coinbase.Value > s.blockReward {
+		return fmt.Errorf("the reward of %d is more than the block reward of %d", coinbase.Value, s.blockReward)
+	}
+
+	s.Balances[coinbase.To] += coinbase.Value
+
+	return nil
+}
+
+func (s *State) applyTXs(txs []SignedTx) error {
 	for _, tx := range txs {
 		err := s.applyTx(tx)
 		if err != nil {
@@ -206,19 +850,32 @@ func (s *State) applyTXs(txs []Tx) error {
 
 // This applies a transaction to the balances
 // It does not store the transaction in the mempool
-func (s *State) applyTx(tx Tx) error {
-	// If this is a reward then just increase the value of the whole pot
+func (s *State) applyTx(tx SignedTx) error {
 	if tx.IsReward() {
-		s.Balances[tx.To] += tx.Value
-		return nil
+		return fmt.Errorf("rewards can only be paid by the coinbase of a block")
+	}
+
+	if !tx.IsAuthentic() {
+		return fmt.Errorf("transaction from '%s' isn't signed by the owner of the account", tx.From)
 	}
 
-	if s.Balances[tx.From] < tx.Value {
+	// Each transaction can only be applied once and in the order they were sent
+	if tx.Nonce != s.nonces[tx.From] {
+		return fmt.Errorf("transaction from '%s' has the nonce %d but the next nonce is %d", tx.From, tx.Nonce, s.nonces[tx.From])
+	}
+
+	if tx.Fee < s.minFee {
+		return fmt.Errorf("transaction from '%s' pays a fee of %d which is less than the minimum fee of %d", tx.From, tx.Fee, s.minFee)
+	}
+
+	if tx.Cost() < tx.Value || s.Balances[tx.From] < tx.Cost() {
 		return fmt.Errorf("insufficient balance")
 	}
 
-	s.Balances[tx.From] -= tx.Value
+	// The fee is taken now and given to the miner once the whole block is applied
+	s.Balances[tx.From] -= tx.Cost()
 	s.Balances[tx.To] += tx.Value
+	s.nonces[tx.From]++
 
 	return nil
 }
@@ -227,15 +884,31 @@ func (s *State) applyTx(tx Tx) error {
 func (s *State) copy() *State {
 	c := State{}
 	c.hasGenesisBlock = s.hasGenesisBlock
+	c.genesisHash = s.genesisHash
 	c.latestBlock = s.latestBlock
 	c.latestBlockHash = s.latestBlockHash
-	c.txMempool = make([]Tx, len(s.txMempool))
+	c.totalWork = new(big.Int).Set(s.totalWork)
+	c.difficulty = s.difficulty
+	c.retargetInterval = s.retargetInterval
+	c.blockTime = s.blockTime
+	c.blockReward = s.blockReward
+	c.maxTimeDrift = s.maxTimeDrift
+	c.minFee = s.minFee
+	c.recentHeaders = make([]BlockHeader, len(s.recentHeaders))
+	copy(c.recentHeaders, s.recentHeaders)
+	c.now = s.now
+	c.txMempool = make([]SignedTx, 0, len(s.txMempool))
 	c.Balances = make(map[Account]uint)
+	c.nonces = make(map[Account]uint64)
 
 	for acc, balance := range s.Balances {
 		c.Balances[acc] = balance
 	}
 
+	for acc, nonce := range s.nonces {
+		c.nonces[acc] = nonce
+	}
+
 	for _, tx := range s.txMempool {
 		c.txMempool = append(c.txMempool, tx)
 	}
@@ -255,10 +928,7 @@ func (s *State) copy() *State {
 //	)
 //	block := NewBlock(s.latestBlockHash, uint64(time.Now().Unix()), s.txMempool)
 //	// Now determine the hash for the whole block
-//	blockHash, err := block.Hash()
-//	if err != nil {
-//		return Hash{}, err
-//	}
+//	blockHash := block.Hash()
 //
 //	// Create the block with the hash
 //	blockFs := BlockFS{blockHash, block}
@@ -0,0 +1,488 @@
+package dao
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextDifficulty(t *testing.T) {
+	testCases := []struct {
+		blockGap uint64
+		want     uint32
+	}{
+		{1, 17},  // Much too fast, harder
+		{15, 16}, // On target, no change
+		{60, 15}, // Much too slow, easier
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d seconds between blocks is difficulty %d", tc.blockGap, tc.want), func(t *testing.T) {
+			s := newTestState(Balances{})
+			for i := uint64(0); i < s.retargetInterval; i++ {
+				h := BlockHeader{BlockNumber: i, Time: 1000 + i*tc.blockGap, Difficulty: 16}
+				s.rememberHeader(h)
+				s.latestBlock = Block{Header: h}
+				s.hasGenesisBlock = true
+			}
+			if got := s.NextDifficulty(); got != tc.want {
+				t.Errorf("got %d; want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNextDifficultyBetweenRetargets(t *testing.T) {
+	s := newTestState(Balances{})
+	h := BlockHeader{BlockNumber: 3, Time: 1000, Difficulty: 18}
+	s.rememberHeader(h)
+	s.latestBlock = Block{Header: h}
+	s.hasGenesisBlock = true
+
+	if got := s.NextDifficulty(); got != 18 {
+		t.Errorf("got %d; want 18", got)
+	}
+}
+
+func TestBlockWithoutProofOfWorkIsRejected(t *testing.T) {
+	s, _ := newTestChainOnDisk(t, 1)
+	defer s.Close()
+
+	// The first nonce that gives a hash short of the difficulty
+	txs := []SignedTx{NewCoinbaseTx(andrej.account, s.blockReward, s.NextBlockNumber())}
+	blockTime := s.MedianTime() + 1
+	var b Block
+	for nonce := uint32(0); ; nonce++ {
+		b = NewBlock(s.NextParentHash(), s.NextBlockNumber(), nonce, blockTime, s.NextDifficulty(), andrej.account, txs)
+		if !IsBlockHashValid(b.Hash(), b.Header.Difficulty) {
+			break
+		}
+	}
+
+	_, err := s.AddBlock(b)
+	if err == nil || !strings.Contains(err.Error(), "proof-of-work") || !strings.Contains(err.Error(), "block 1 ") || !strings.Contains(err.Error(), b.Hash().Hex()) {
+		t.Errorf("got %v; want block 1 '%s' rejected for its proof-of-work", err, b.Hash().Hex())
+	}
+	if s.NextBlockNumber() != 1 {
+		t.Errorf("the chain moved on to block %d", s.NextBlockNumber())
+	}
+}
+
+func TestStoredBlockWithTheWrongHashIsRejected(t *testing.T) {
+	s, hashes := newTestChainOnDisk(t, 2)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Block 1 is stored under a hash that isn't its own, which is the same length so the file still reads
+	forged := Hash{0xab}
+	blockDbFilePath := getBlocksDbFilePath(s.dataDir)
+	content, err := ioutil.ReadFile(blockDbFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = []byte(strings.Replace(string(content), `"hash":"`+hashes[1].Hex(), `"hash":"`+forged.Hex(), 1))
+	if err := ioutil.WriteFile(blockDbFilePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadStateFromDisk(s.dataDir)
+	if err == nil || !strings.Contains(err.Error(), "Block 1 ") || !strings.Contains(err.Error(), forged.Hex()) || !strings.Contains(err.Error(), hashes[1].Hex()) {
+		t.Errorf("got %v; want block 1 refused as it's stored as '%s' but hashes to '%s'", err, forged.Hex(), hashes[1].Hex())
+	}
+}
+
+func TestAddTxChecksTheMempool(t *testing.T) {
+	s := newTestState(Balances{andrej.account: 100})
+
+	if err := s.AddTx(andrej.signTx(babayaga.account, 0, 60, 0, "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddTx(andrej.signTx(babayaga.account, 1, 60, 0, "")); err == nil {
+		t.Error("spending the same tokens twice in the mempool should fail")
+	}
+	if got := len(s.PendingTXs()); got != 1 {
+		t.Errorf("got %d pending TXs; want 1", got)
+	}
+	if got := s.Balances[andrej.account]; got != 100 {
+		t.Errorf("pending TXs changed the balance to %d; want 100", got)
+	}
+}
+
+func TestRemoveMinedTXs(t *testing.T) {
+	mined := andrej.signTx(babayaga.account, 0, 60, 0, "")
+	pending := andrej.signTx(caesar.account, 1, 30, 0, "")
+	s := newTestState(Balances{andrej.account: 40, babayaga.account: 60})
+	s.nonces[andrej.account] = 1
+	s.txMempool = []SignedTx{mined, pending}
+
+	s.removeMinedTXs([]SignedTx{mined})
+
+	if got := s.PendingTXs(); len(got) != 1 || !reflect.DeepEqual(got[0], pending) {
+		t.Errorf("got %v; want %v", got, []SignedTx{pending})
+	}
+}
+
+func TestApplyCoinbase(t *testing.T) {
+	testCases := []struct {
+		name  string
+		txs   []SignedTx
+		valid bool
+	}{
+		{"reward to the miner", []SignedTx{NewCoinbaseTx(andrej.account, 100, 0)}, true},
+		{"less than the block reward", []SignedTx{NewCoinbaseTx(andrej.account, 50, 0)}, true},
+		{"no coinbase", []SignedTx{andrej.signTx(babayaga.account, 0, 1, 0, "vodka")}, false},
+		{"more than the block reward", []SignedTx{NewCoinbaseTx(andrej.account, 101, 0)}, false},
+		{"reward to someone else", []SignedTx{NewCoinbaseTx(babayaga.account, 100, 0)}, false},
+		{"reward of another block", []SignedTx{NewCoinbaseTx(andrej.account, 100, 1)}, false},
+		{"reward from an account", []SignedTx{babayaga.signTx(andrej.account, 0, 100, 0, "reward")}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestState(Balances{})
+			b := NewBlock(Hash{}, 0, 0, 0, 16, andrej.account, tc.txs)
+			if err := s.applyCoinbase(b); (err == nil) != tc.valid {
+				t.Errorf("got %v; want valid %t", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestApplyTxChecksTheSignature(t *testing.T) {
+	tx := andrej.signTx(babayaga.account, 0, 10, 0, "vodka")
+
+	forged := tx
+	forged.From = babayaga.account
+
+	tampered := tx
+	tampered.Value = 100
+
+	unsigned := tx
+	unsigned.Sig = nil
+
+	testCases := []struct {
+		name  string
+		tx    SignedTx
+		valid bool
+	}{
+		{"signed by the sender", tx, true},
+		{"signed by someone else", forged, false},
+		{"changed after signing", tampered, false},
+		{"unsigned", unsigned, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestState(Balances{andrej.account: 100, babayaga.account: 100})
+			if err := s.applyTx(tc.tx); (err == nil) != tc.valid {
+				t.Errorf("got %v; want valid %t", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestApplyTxChecksTheNonce(t *testing.T) {
+	s := newTestState(Balances{andrej.account: 100})
+
+	first := andrej.signTx(babayaga.account, 0, 10, 0, "vodka")
+	if err := s.applyTx(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.applyTx(first); err == nil {
+		t.Error("replaying a TX should fail")
+	}
+	if err := s.applyTx(andrej.signTx(babayaga.account, 2, 10, 0, "vodka")); err == nil {
+		t.Error("skipping a nonce should fail")
+	}
+	if err := s.applyTx(andrej.signTx(babayaga.account, 1, 10, 0, "vodka")); err != nil {
+		t.Errorf("the next nonce should be accepted: %s", err)
+	}
+	if got := s.nonces[andrej.account]; got != 2 {
+		t.Errorf("got nonce %d; want 2", got)
+	}
+}
+
+func TestNextNonceCountsTheMempool(t *testing.T) {
+	s := newTestState(Balances{andrej.account: 100})
+	s.nonces[andrej.account] = 3
+
+	if err := s.AddTx(andrej.signTx(babayaga.account, 3, 10, 0, "vodka")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.NextNonce(andrej.account); got != 4 {
+		t.Errorf("got %d; want 4", got)
+	}
+	if got := s.NextNonce(babayaga.account); got != 0 {
+		t.Errorf("got %d for an account that has sent nothing; want 0", got)
+	}
+}
+
+func TestApplyTxChecksTheFee(t *testing.T) {
+	s := newTestState(Balances{andrej.account: 100})
+	s.minFee = 2
+
+	if err := s.applyTx(andrej.signTx(babayaga.account, 0, 10, 1, "vodka")); err == nil {
+		t.Error("a fee below the minimum should fail")
+	}
+	if err := s.applyTx(andrej.signTx(babayaga.account, 0, 99, 2, "vodka")); err == nil {
+		t.Error("the fee should be paid from the balance as well as the value")
+	}
+	if err := s.applyTx(andrej.signTx(babayaga.account, 0, 98, 2, "vodka")); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Balances[andrej.account]; got != 0 {
+		t.Errorf("got balance %d; want 0", got)
+	}
+}
+
+func TestFeesArePaidToTheMiner(t *testing.T) {
+	s := newTestState(Balances{andrej.account: 100, babayaga.account: 100})
+	s.difficulty = 1
+
+	b := mineTestBlock(t, s, caesar.account, []SignedTx{
+		andrej.signTx(babayaga.account, 0, 10, 3, "vodka"),
+		babayaga.signTx(andrej.account, 0, 10, 4, "vodka"),
+	})
+	if err := s.applyBlock(b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Balances{andrej.account: 97, babayaga.account: 96, caesar.account: DefaultBlockReward + 7}
+	if !reflect.DeepEqual(s.Balances, want) {
+		t.Errorf("got balances %v; want %v", s.Balances, want)
+	}
+}
+
+func TestPendingTXsAreOrderedByFee(t *testing.T) {
+	s := newTestState(Balances{andrej.account: 100, babayaga.account: 100})
+
+	cheap := andrej.signTx(caesar.account, 0, 10, 1, "")
+	expensiveAfterCheap := andrej.signTx(caesar.account, 1, 10, 9, "")
+	middle := babayaga.signTx(caesar.account, 0, 10, 5, "")
+	spendsReceived := caesar.signTx(andrej.account, 0, 10, 8, "") // Needs the tokens from andrej and babayaga
+	for _, tx := range []SignedTx{cheap, expensiveAfterCheap, middle, spendsReceived} {
+		if err := s.AddTx(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []SignedTx{middle, cheap, expensiveAfterCheap, spendsReceived}
+	if got := s.PendingTXs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestApplyTxRejectsRewards(t *testing.T) {
+	s := newTestState(Balances{})
+	if err := s.applyTx(andrej.signTx(andrej.account, 0, 700, 0, "reward")); err == nil {
+		t.Error("a reward outside the coinbase should be rejected")
+	}
+}
+
+// Accounts with the keys to sign their transactions
+var andrej, babayaga, caesar = newTestKey(), newTestKey(), newTestKey()
+
+type testKey struct {
+	account    Account
+	privateKey ed25519.PrivateKey
+}
+
+func newTestKey() testKey {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	return testKey{NewAccountFromPublicKey(publicKey), privateKey}
+}
+
+func (k testKey) signTx(to Account, nonce uint64, value uint, fee uint, data string) SignedTx {
+	return NewSignedTx(NewTx(k.account, to, nonce, value, fee, data), k.privateKey)
+}
+
+// A state with the default chain parameters that keeps its blocks in memory
+func newTestState(balances Balances) *State {
+	return &State{
+		Balances:         balances,
+		nonces:           make(map[Account]uint64),
+		blocks:           newMemoryStore(),
+		txs:              newTxIndex(""),
+		txMempool:        make([]SignedTx, 0),
+		totalWork:        big.NewInt(0),
+		difficulty:       DefaultDifficulty,
+		retargetInterval: DefaultRetargetInterval,
+		blockTime:        DefaultBlockTime,
+		blockReward:      DefaultBlockReward,
+		maxTimeDrift:     DefaultMaxTimeDrift,
+		now:              time.Now,
+	}
+}
+
+func TestAddBranchReorganisesToTheHeaviestChain(t *testing.T) {
+	s, _ := newTestChainOnDisk(t, 1)
+	forkPoint := s.LatestBlockHash()
+	forkState := s.copy()
+
+	// This node mines one block
+	displacedTx := andrej.signTx(babayaga.account, 0, 10, 0, "vodka")
+	if _, err := s.AddBlock(mineTestBlock(t, s, andrej.account, []SignedTx{displacedTx})); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whilst a peer mines two blocks on the same parent
+	block1 := mineTestBlock(t, forkState, caesar.account, []SignedTx{caesar.signTx(babayaga.account, 0, 20, 0, "rent")})
+	if err := forkState.applyBlockFs(BlockFS{block1.Hash(), block1}); err != nil {
+		t.Fatal(err)
+	}
+	block2 := mineTestBlock(t, forkState, caesar.account, []SignedTx{})
+	if err := forkState.applyBlockFs(BlockFS{block2.Hash(), block2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AddBranch(forkPoint, []Block{block1, block2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.LatestBlockHash() != block2.Hash() {
+		t.Errorf("latest block is '%s'; want '%s'", s.LatestBlockHash().Hex(), block2.Hash().Hex())
+	}
+	want := Balances{andrej.account: 200, babayaga.account: 20, caesar.account: 180}
+	if !reflect.DeepEqual(s.Balances, want) {
+		t.Errorf("got balances %v; want %v", s.Balances, want)
+	}
+	if got := s.PendingTXs(); len(got) != 1 || !reflect.DeepEqual(got[0], displacedTx) {
+		t.Errorf("got pending TXs %v; want %v", got, []SignedTx{displacedTx})
+	}
+	if history, _ := accountHistory(t, s, babayaga.account, "", 0, 10); !reflect.DeepEqual(history, []string{"1 in rent"}) {
+		t.Errorf("got babayaga's history %v; want only the rent from the branch", history)
+	}
+
+	// The block file must hold the new chain
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadStateFromDisk(s.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if reloaded.LatestBlockHash() != s.LatestBlockHash() || !reflect.DeepEqual(reloaded.Balances, want) {
+		t.Errorf("reloaded state is at '%s' with %v", reloaded.LatestBlockHash().Hex(), reloaded.Balances)
+	}
+}
+
+func TestAddBranchKeepsTheHeavierChain(t *testing.T) {
+	s, _ := newTestChainOnDisk(t, 1)
+	defer s.Close()
+
+	forkState := s.copy()
+	if _, err := s.AddBlock(mineTestBlock(t, s, andrej.account, []SignedTx{})); err != nil {
+		t.Fatal(err)
+	}
+	latestBlockHash := s.LatestBlockHash()
+
+	if err := s.AddBranch(forkState.LatestBlockHash(), []Block{mineTestBlock(t, forkState, caesar.account, []SignedTx{})}); err == nil {
+		t.Error("a branch with the same work should be rejected")
+	}
+	if s.LatestBlockHash() != latestBlockHash {
+		t.Errorf("latest block changed to '%s'", s.LatestBlockHash().Hex())
+	}
+}
+
+// The genesis of the test chains on disk, andrej starts with 100 and blocks are quick to mine
+var testGenesisJson = fmt.Sprintf(`{"difficulty": 1, "balances": {"%s": 100}}`, andrej.account)
+
+// A test chain on disk of length empty blocks mined by andrej
+func newTestChainOnDisk(t *testing.T, length int) (*State, []Hash) {
+	s := newTestStateOnDisk(t, testGenesisJson)
+	return s, addTestBlocks(t, s, andrej.account, make([][]SignedTx, length)...)
+}
+
+// Mine a block with each of the lists of transactions on top of the state and add them
+func addTestBlocks(t *testing.T, s *State, miner Account, blocks ...[]SignedTx) []Hash {
+	hashes := make([]Hash, 0, len(blocks))
+	for _, txs := range blocks {
+		hash, err := s.AddBlock(mineTestBlock(t, s, miner, txs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// A state backed by a data directory with the given genesis file
+func newTestStateOnDisk(t *testing.T, genesisJson string) *State {
+	dataDir := t.TempDir()
+	if err := os.MkdirAll(getDatabaseDirPath(dataDir), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(GetGenesisJsonFilePath(dataDir), []byte(genesisJson), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := LoadStateFromDisk(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Mine the next block on top of the state
+func mineTestBlock(t *testing.T, s *State, miner Account, txs []SignedTx) Block {
+	blockTime := uint64(s.now().Unix())
+	if blockTime <= s.MedianTime() {
+		blockTime = s.MedianTime() + 1
+	}
+	return mineTestBlockAt(t, s, miner, txs, blockTime)
+}
+
+func TestBlockTimeRules(t *testing.T) {
+	clock := time.Unix(1000000, 0)
+	testCases := []struct {
+		name      string
+		blockTime uint64
+		valid     bool
+	}{
+		{"after the median", 999991, true},
+		{"at the median", 999990, false},
+		{"before the median", 999900, false},
+		{"at the limit of the drift", 1000000 + DefaultMaxTimeDrift, true},
+		{"too far in the future", 1000000 + DefaultMaxTimeDrift + 1, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestState(Balances{})
+			s.SetClock(func() time.Time { return clock })
+			s.difficulty = 1
+
+			// Blocks 999980, 999982 ... 999998 give a median of 999990
+			for i := uint64(0); i < 10; i++ {
+				b := mineTestBlockAt(t, s, andrej.account, []SignedTx{}, 999980+i*2)
+				if err := s.applyBlockFs(BlockFS{b.Hash(), b}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			b := mineTestBlockAt(t, s, andrej.account, []SignedTx{}, tc.blockTime)
+			if err := s.applyBlock(b); (err == nil) != tc.valid {
+				t.Errorf("got %v; want valid %t", err, tc.valid)
+			}
+		})
+	}
+}
+
+// Mine the next block on top of the state at a given time
+func mineTestBlockAt(t *testing.T, s *State, miner Account, txs []SignedTx, blockTime uint64) Block {
+	txs = append([]SignedTx{NewCoinbaseTx(miner, s.blockReward, s.NextBlockNumber())}, txs...)
+	for nonce := uint32(0); ; nonce++ {
+		b := NewBlock(s.NextParentHash(), s.NextBlockNumber(), nonce, blockTime, s.NextDifficulty(), miner, txs)
+		if IsBlockHashValid(b.Hash(), b.Header.Difficulty) {
+			return b
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// StoreKind is how the blocks of the chain are stored
+type StoreKind string
+
+// StoreJSON writes each block as a line of json to the block file, with an index of where each block starts
+const StoreJSON StoreKind = "json"
+
+// StoreSegmented writes the blocks in a compact binary form to a series of segment files
+const StoreSegmented StoreKind = "segmented"
+
+// StoreMemory keeps the blocks in memory, so they're gone when the node stops
+const StoreMemory StoreKind = "memory"
+
+func ParseStoreKind(kind string) (StoreKind, error) {
+	switch StoreKind(kind) {
+	case StoreJSON, StoreSegmented, StoreMemory:
+		return StoreKind(kind), nil
+	}
+	return "", fmt.Errorf("The block store must be '%s', '%s' or '%s' not '%s'", StoreJSON, StoreSegmented, StoreMemory, kind)
+}
+
+// BlockStore keeps the blocks of the chain in order, block N at height N
+//
+// A store isn't safe for concurrent use, the State serialises access to it.
+type BlockStore interface {
+	Kind() StoreKind
+
+	// Len is how many blocks there are, which is the height of the next block
+	Len() uint64
+
+	// Append adds the block to the end of the chain
+	Append(blockFs BlockFS) error
+
+	// GetByHeight and GetByHash return ErrBlockNotFound for a block that isn't stored
+	GetByHeight(height uint64) (BlockFS, error)
+	GetByHash(hash Hash) (BlockFS, error)
+
+	// Iterate calls fn with each block in order from the height onwards
+	// It stops at the first error fn returns, return errStopIterating to stop early
+	Iterate(from uint64, fn func(BlockFS) error) error
+
+	// Truncate removes the blocks from the height length onwards
+	Truncate(length uint64) error
+
+	// SetSyncPolicy changes when appended blocks are flushed to the disk
+	SetSyncPolicy(policy SyncPolicy)
+
+	Close() error
+}
+
+// errStopIterating is returned by an Iterate callback that has found what it wants
+var errStopIterating = errors.New("stop iterating")
+
+// Open the store of the kind in the data dir
+// An empty kind is whichever store already holds blocks in the data dir, json for a new one.
+// A store opened read only doesn't change any files, so it can't be appended to or truncated
+// and refuses to open blocks that need recovering from a crash.
+func openBlockStore(dataDir string, kind StoreKind, readOnly bool) (BlockStore, error) {
+	existing, err := existingStoreKind(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "" {
+		kind = existing
+	}
+	if existing != "" && existing != kind {
+		return nil, fmt.Errorf("The data dir already holds blocks in a %s store, not a %s store", existing, kind)
+	}
+
+	// There are no blocks to read and a read only store can't create the files
+	if readOnly && existing == "" {
+		return newMemoryStore(), nil
+	}
+
+	switch kind {
+	case StoreSegmented:
+		return openSegmentStore(dataDir, readOnly)
+	case StoreMemory:
+		return newMemoryStore(), nil
+	default:
+		return openJSONStore(dataDir, readOnly)
+	}
+}
+
+// The kind of store in the data dir, empty when there's none yet
+func existingStoreKind(dataDir string) (StoreKind, error) {
+	info, err := os.Stat(getBlocksDbFilePath(dataDir))
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("Cannot read the block file: %w", err)
+	}
+	if err == nil && info.Size() > 0 {
+		return StoreJSON, nil
+	}
+
+	// The directory is created when the store is first opened, before there are any segments
+	segmented, err := dirExists(getSegmentsDirPath(dataDir))
+	if err != nil {
+		return "", fmt.Errorf("Cannot read the segments: %w", err)
+	}
+	if segmented {
+		return StoreSegmented, nil
+	}
+
+	return "", nil
+}
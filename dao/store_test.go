@@ -0,0 +1,246 @@
+package dao
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// The blocks of a short chain with a transfer in each block after the first
+func newTestBlocks(t *testing.T, length int) []BlockFS {
+	s := newTestState(Balances{andrej.account: 100})
+	s.difficulty = 1
+
+	blocks := make([]BlockFS, 0, length)
+	for i := 0; i < length; i++ {
+		txs := []SignedTx{}
+		if i > 0 {
+			txs = append(txs, andrej.signTx(babayaga.account, uint64(i-1), 10, 1, "rent"))
+		}
+		b := mineTestBlock(t, s, caesar.account, txs)
+		hash, err := s.AddBlock(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, BlockFS{hash, b})
+	}
+
+	return blocks
+}
+
+func newTestDataDir(t *testing.T) string {
+	dataDir := t.TempDir()
+	if err := os.MkdirAll(getDatabaseDirPath(dataDir), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	return dataDir
+}
+
+func TestBlockStores(t *testing.T) {
+	blocks := newTestBlocks(t, 4)
+
+	for _, kind := range []StoreKind{StoreJSON, StoreSegmented, StoreMemory} {
+		t.Run(string(kind), func(t *testing.T) {
+			dataDir := newTestDataDir(t)
+			store, err := openBlockStore(dataDir, kind, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, blockFs := range blocks {
+				if err := store.Append(blockFs); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for height, want := range blocks {
+				byHeight, err := store.GetByHeight(uint64(height))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(byHeight, want) {
+					t.Errorf("got block %v at height %d; want %v", byHeight, height, want)
+				}
+				byHash, err := store.GetByHash(want.Key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(byHash, want) {
+					t.Errorf("got block %v for '%s'; want %v", byHash, want.Key.Hex(), want)
+				}
+			}
+			if _, err := store.GetByHeight(uint64(len(blocks))); !errors.Is(err, ErrBlockNotFound) {
+				t.Errorf("got %v beyond the latest block; want %v", err, ErrBlockNotFound)
+			}
+
+			iterated := make([]Hash, 0)
+			err = store.Iterate(2, func(blockFs BlockFS) error {
+				iterated = append(iterated, blockFs.Key)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []Hash{blocks[2].Key, blocks[3].Key}; !reflect.DeepEqual(iterated, want) {
+				t.Errorf("iterated over %v; want %v", iterated, want)
+			}
+
+			// Replace the latest two blocks with one of them again
+			if err := store.Truncate(2); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.GetByHash(blocks[3].Key); !errors.Is(err, ErrBlockNotFound) {
+				t.Errorf("got %v for a removed block; want %v", err, ErrBlockNotFound)
+			}
+			if err := store.Append(blocks[2]); err != nil {
+				t.Fatal(err)
+			}
+			if store.Len() != 3 {
+				t.Errorf("got %d blocks; want 3", store.Len())
+			}
+
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if kind == StoreMemory {
+				return
+			}
+
+			reopened, err := openBlockStore(dataDir, "", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+
+			if reopened.Kind() != kind || reopened.Len() != 3 {
+				t.Errorf("reopened a %s store of %d blocks; want a %s store of 3", reopened.Kind(), reopened.Len(), kind)
+			}
+			latest, err := reopened.GetByHeight(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(latest, blocks[2]) {
+				t.Errorf("got block %v; want %v", latest, blocks[2])
+			}
+		})
+	}
+}
+
+func TestSegmentStoreRemovesAPartialBlock(t *testing.T) {
+	blocks := newTestBlocks(t, 3)
+	dataDir := newTestDataDir(t)
+
+	store, err := openSegmentStore(dataDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blockFs := range blocks[:2] {
+		if err := store.Append(blockFs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash whilst the third block was being written
+	segmentPath := getSegmentFilePath(getSegmentsDirPath(dataDir), 0)
+	info, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(segmentPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(append([]byte{0, 0, 1, 0, 0xde, 0xad, 0xbe, 0xef}, blocks[2].Key[:]...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openSegmentStore(dataDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if reopened.Len() != 2 {
+		t.Errorf("got %d blocks; want 2", reopened.Len())
+	}
+	recovered, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.Size() != info.Size() {
+		t.Errorf("the segment is %d bytes; want %d", recovered.Size(), info.Size())
+	}
+
+	// The chain carries on from the last whole block
+	if err := reopened.Append(blocks[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.GetByHeight(2); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSegmentStoreRefusesABrokenBlockBeforeTheEnd(t *testing.T) {
+	blocks := newTestBlocks(t, 3)
+	dataDir := newTestDataDir(t)
+
+	store, err := openSegmentStore(dataDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blockFs := range blocks {
+		if err := store.Append(blockFs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secondOffset := store.locations[1].offset
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The length of the second block is too short for even its hash
+	segmentPath := getSegmentFilePath(getSegmentsDirPath(dataDir), 0)
+	info, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(segmentPath, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0, 0, 0, 4}, secondOffset); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if reopened, err := openSegmentStore(dataDir, false); err == nil {
+		reopened.Close()
+		t.Fatal("opened a segment with a broken block before the end")
+	}
+	kept, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept.Size() != info.Size() {
+		t.Errorf("the segment is %d bytes; want the %d bytes left as they were", kept.Size(), info.Size())
+	}
+}
+
+func TestStoreMustMatchTheDataDir(t *testing.T) {
+	s, _ := newTestChainOnDisk(t, 1)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadStateWithStore(s.dataDir, StoreSegmented); err == nil {
+		t.Errorf("opened the json blocks as a %s store", StoreSegmented)
+	}
+}
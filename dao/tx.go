@@ -1,16 +1,68 @@
 package dao
 
+import (
+	"crypto/ed25519"
+)
+
 type Tx struct {
 	From  Account `json:"from"`
 	To    Account `json:"to"`
+	Nonce uint64  `json:"nonce"` // How many transactions From has sent before this one
 	Value uint    `json:"value"`
+	Fee   uint    `json:"fee"` // Paid to the miner of the block on top of the value
 	Data  string  `json:"data"`
 }
 
-func NewTx(from Account, to Account, value uint, data string) Tx {
-	return Tx{from, to, value, data}
+// SignedTx is a transaction signed by the owner of the From account
+type SignedTx struct {
+	Tx
+	PublicKey []byte `json:"public_key"` // The public key of the From account
+	Sig       []byte `json:"signature"`  // The signature of the transaction hash
+}
+
+func NewTx(from Account, to Account, nonce uint64, value uint, fee uint, data string) Tx {
+	return Tx{from, to, nonce, value, fee, data}
+}
+
+// NewSignedTx signs the transaction with the private key of the From account
+func NewSignedTx(tx Tx, privateKey ed25519.PrivateKey) SignedTx {
+	txHash := tx.Hash()
+	return SignedTx{tx, privateKey.Public().(ed25519.PublicKey), ed25519.Sign(privateKey, txHash[:])}
+}
+
+// The coinbase is the first transaction in a block and rewards the miner
+// Nobody sends the reward so there is nobody to sign it. Its nonce is the number of the block
+// so the rewards of a miner each have their own hash.
+func NewCoinbaseTx(miner Account, reward uint, blockNumber uint64) SignedTx {
+	return SignedTx{Tx: Tx{"", miner, blockNumber, reward, 0, "reward"}}
 }
 
 func (t Tx) IsReward() bool {
 	return t.Data == "reward"
 }
+
+// Cost is what the sender pays for the transaction
+func (t Tx) Cost() uint {
+	return t.Value + t.Fee
+}
+
+// Hash of the transaction is what the sender signs
+// It's the hash of the canonical encoding, see encoding.go
+func (t Tx) Hash() Hash {
+	return prefixedHash(txHashPrefix, t.Encode())
+}
+
+// Hash identifies the signed transaction
+func (t SignedTx) Hash() Hash {
+	return prefixedHash(signedTxHashPrefix, t.Encode())
+}
+
+// IsAuthentic checks the transaction was signed by the owner of the From account
+func (t SignedTx) IsAuthentic() bool {
+	if len(t.PublicKey) != ed25519.PublicKeySize || NewAccountFromPublicKey(t.PublicKey) != t.From {
+		return false
+	}
+
+	txHash := t.Tx.Hash()
+	return ed25519.Verify(t.PublicKey, txHash[:], t.Sig)
+}
@@ -0,0 +1,362 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// TxDirection is whether a transaction paid an account or was paid by it
+type TxDirection string
+
+// TxIn is a transaction that paid the account, including the reward for mining a block
+const TxIn TxDirection = "in"
+
+// TxOut is a transaction the account paid
+const TxOut TxDirection = "out"
+
+// TxSelf is a transaction the account paid to itself, it's both in and out
+const TxSelf TxDirection = "self"
+
+// ParseTxDirection parses the direction to filter an account's transactions by, empty or all is every one
+func ParseTxDirection(direction string) (TxDirection, error) {
+	switch direction {
+	case "", "all":
+		return "", nil
+	case string(TxIn), string(TxOut):
+		return TxDirection(direction), nil
+	}
+	return "", fmt.Errorf("The direction must be '%s', '%s' or 'all' not '%s'", TxIn, TxOut, direction)
+}
+
+// Does a transaction in the direction pass the filter
+func (d TxDirection) matches(filter TxDirection) bool {
+	return filter == "" || d == filter || d == TxSelf
+}
+
+// AccountTx is a transaction of an account and the block it's in
+type AccountTx struct {
+	BlockNumber uint64
+	BlockHash   Hash
+	Time        uint64 // When the block was mined
+	Tx          SignedTx
+	Direction   TxDirection
+}
+
+// The transaction index finds a transaction by its hash, and the transactions of an
+// account, without reading every block
+//
+// The Nth record of the index file is block N, its hash and then each of its transactions
+// as the hash of the transaction and the accounts it pays or is paid by, each with the
+// direction. The whole index is kept in memory. Whatever doesn't match the blocks when
+// it's loaded is rebuilt, and blocks added since it was written are indexed.
+type txIndex struct {
+	path      string                   // The index file, empty for an index only kept in memory
+	blocks    []indexedBlock           // The indexed blocks by height
+	positions map[Hash]txPosition      // Where each transaction is by its hash
+	accounts  map[Account][]txLocation // The transactions of each account, oldest first
+
+	syncPolicy SyncPolicy // When the index file is flushed to the disk after it's replaced
+}
+
+// A block as it's recorded in the index
+type indexedBlock struct {
+	hash Hash
+	txs  []txEntry
+}
+
+// A transaction in a block and the accounts it pays or is paid by
+type txEntry struct {
+	hash     Hash
+	accounts []accountEntry
+}
+
+type accountEntry struct {
+	account   Account
+	direction TxDirection
+}
+
+// Where a transaction is in the chain
+type txPosition struct {
+	height uint64
+	index  uint32 // The position of the transaction in the block
+}
+
+// Where a transaction of an account is in the chain
+type txLocation struct {
+	txPosition
+	direction TxDirection
+}
+
+func newTxIndex(path string) *txIndex {
+	return &txIndex{path, make([]indexedBlock, 0), make(map[Hash]txPosition), make(map[Account][]txLocation), SyncAlways}
+}
+
+// Load the transaction index of the blocks, rebuilding it if it doesn't match them
+// The index of a memory store is only kept in memory, as is one loaded read only.
+func loadTxIndex(dataDir string, blocks BlockStore, readOnly bool) (*txIndex, error) {
+	path := getTxIndexFilePath(dataDir)
+	if blocks.Kind() == StoreMemory {
+		path = ""
+	}
+
+	index, err := readTxIndex(path, blocks)
+	rebuilt := err != nil
+	if err != nil {
+		// Data dirs from before transactions were indexed don't have one
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Rebuilding the transaction index: %s\n", err)
+		}
+		index = newTxIndex(path)
+	}
+
+	indexed := index.len()
+	err = blocks.Iterate(indexed, func(blockFs BlockFS) error {
+		index.add(indexBlock(blockFs))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot index the transactions: %w", err)
+	}
+
+	if !readOnly && (rebuilt || index.len() > indexed) {
+		warnIndexRebuilt(index.write())
+	}
+
+	return index, nil
+}
+
+func readTxIndex(path string, blocks BlockStore) (*txIndex, error) {
+	if path == "" {
+		return nil, os.ErrNotExist
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index := newTxIndex(path)
+	d := &decoder{buf: content}
+	for len(d.buf) > 0 && d.err == nil {
+		block := indexedBlock{hash: d.hash()}
+		txCount := d.uint32()
+		for i := uint32(0); i < txCount && d.err == nil; i++ {
+			entry := txEntry{hash: d.hash()}
+			accountCount := d.uint32()
+			for j := uint32(0); j < accountCount && d.err == nil; j++ {
+				entry.accounts = append(entry.accounts, accountEntry{Account(d.string()), TxDirection(d.string())})
+			}
+			block.txs = append(block.txs, entry)
+		}
+		index.add(block)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("the index has a partial record")
+	}
+
+	// The last record must be the block at its height
+	if index.len() > blocks.Len() {
+		return nil, fmt.Errorf("the index has %d blocks but there are only %d", index.len(), blocks.Len())
+	}
+	if index.len() > 0 {
+		latest := index.len() - 1
+		blockFs, err := blocks.GetByHeight(latest)
+		if err != nil {
+			return nil, err
+		}
+		if blockFs.Key != index.blocks[latest].hash {
+			return nil, fmt.Errorf("the index has block '%s' at %d not '%s'", index.blocks[latest].hash.Hex(), latest, blockFs.Key.Hex())
+		}
+	}
+
+	return index, nil
+}
+
+func (ti *txIndex) len() uint64 {
+	return uint64(len(ti.blocks))
+}
+
+// Add the next block to the index in memory
+func (ti *txIndex) add(block indexedBlock) {
+	height := ti.len()
+	ti.blocks = append(ti.blocks, block)
+	for i, entry := range block.txs {
+		position := txPosition{height, uint32(i)}
+		ti.positions[entry.hash] = position
+		for _, accountEntry := range entry.accounts {
+			ti.accounts[accountEntry.account] = append(ti.accounts[accountEntry.account], txLocation{position, accountEntry.direction})
+		}
+	}
+}
+
+// Record the block added to the end of the chain, in memory even if the file can't be
+func (ti *txIndex) append(blockFs BlockFS) error {
+	if ti == nil {
+		return nil
+	}
+	block := indexBlock(blockFs)
+	ti.add(block)
+	if ti.path == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(ti.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Cannot open the transaction index: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(block.encode())
+	if err != nil {
+		return fmt.Errorf("Cannot append to the transaction index: %w", err)
+	}
+
+	return nil
+}
+
+// Remove the blocks from the height length onwards from the index
+func (ti *txIndex) truncate(length uint64) error {
+	if ti == nil || length >= ti.len() {
+		return nil
+	}
+
+	for _, block := range ti.blocks[length:] {
+		for _, entry := range block.txs {
+			delete(ti.positions, entry.hash)
+		}
+	}
+	for account, locations := range ti.accounts {
+		kept := sort.Search(len(locations), func(i int) bool { return locations[i].height >= length })
+		if kept == 0 {
+			delete(ti.accounts, account)
+		} else {
+			ti.accounts[account] = locations[:kept]
+		}
+	}
+	ti.blocks = ti.blocks[:length]
+
+	return ti.write()
+}
+
+// Replace the index file with the whole index
+func (ti *txIndex) write() error {
+	if ti.path == "" {
+		return nil
+	}
+
+	records := make([]byte, 0)
+	for _, block := range ti.blocks {
+		records = append(records, block.encode()...)
+	}
+
+	err := writeFileAtomically(ti.path, records, ti.syncPolicy)
+	if err != nil {
+		return fmt.Errorf("Cannot write the transaction index: %w", err)
+	}
+
+	return nil
+}
+
+// Where the transaction with the hash is in the chain
+func (ti *txIndex) position(txHash Hash) (txPosition, bool) {
+	if ti == nil {
+		return txPosition{}, false
+	}
+	position, ok := ti.positions[txHash]
+	return position, ok
+}
+
+// The transactions of the account in the direction, newest first
+func (ti *txIndex) locations(account Account, direction TxDirection) []txLocation {
+	if ti == nil {
+		return []txLocation{}
+	}
+
+	all := ti.accounts[account]
+	matching := make([]txLocation, 0, len(all))
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].direction.matches(direction) {
+			matching = append(matching, all[i])
+		}
+	}
+	return matching
+}
+
+// The hash of each transaction in the block and the accounts it pays or is paid by
+func indexBlock(blockFs BlockFS) indexedBlock {
+	txs := make([]txEntry, len(blockFs.Value.TXs))
+	for i, tx := range blockFs.Value.TXs {
+		txs[i].hash = tx.Hash()
+		switch {
+		case tx.From == tx.To:
+			txs[i].accounts = []accountEntry{{tx.From, TxSelf}}
+		case tx.From == "":
+			// Nobody sends the reward for mining the block
+			txs[i].accounts = []accountEntry{{tx.To, TxIn}}
+		default:
+			txs[i].accounts = []accountEntry{{tx.From, TxOut}, {tx.To, TxIn}}
+		}
+	}
+	return indexedBlock{blockFs.Key, txs}
+}
+
+func (b indexedBlock) encode() []byte {
+	e := &encoder{}
+	e.hash(b.hash)
+	e.uint32(uint32(len(b.txs)))
+	for _, entry := range b.txs {
+		e.hash(entry.hash)
+		e.uint32(uint32(len(entry.accounts)))
+		for _, accountEntry := range entry.accounts {
+			e.string(string(accountEntry.account))
+			e.string(string(accountEntry.direction))
+		}
+	}
+	return e.buf
+}
+
+// GetAccountTxs returns the transactions of the account in the direction, newest first
+// It skips the first offset of them and returns at most limit, along with how many there are.
+func GetAccountTxs(account Account, direction TxDirection, offset int, limit int, s *State) ([]AccountTx, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	locations := s.txs.locations(account, direction)
+	total := len(locations)
+	if offset > total {
+		offset = total
+	}
+	if limit < total-offset {
+		locations = locations[offset : offset+limit]
+	} else {
+		locations = locations[offset:]
+	}
+
+	accountTxs := make([]AccountTx, 0, len(locations))
+	var blockFs BlockFS
+	for _, location := range locations {
+		// An account often has several transactions in a block
+		if len(accountTxs) == 0 || blockFs.Value.Header.BlockNumber != location.height {
+			var err error
+			blockFs, err = s.blocks.GetByHeight(location.height)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		if int(location.index) >= len(blockFs.Value.TXs) {
+			return nil, 0, fmt.Errorf("The transaction index has TX %d of block %d which only has %d", location.index, location.height, len(blockFs.Value.TXs))
+		}
+
+		accountTxs = append(accountTxs, AccountTx{
+			BlockNumber: location.height,
+			BlockHash:   blockFs.Key,
+			Time:        blockFs.Value.Header.Time,
+			Tx:          blockFs.Value.TXs[location.index],
+			Direction:   location.direction,
+		})
+	}
+
+	return accountTxs, total, nil
+}
@@ -0,0 +1,144 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// A chain where babayaga is paid, pays andrej back, pays herself and then mines a block
+func newTestAccountChain(t *testing.T) *State {
+	s, _ := newTestChainOnDisk(t, 0)
+	addTestBlocks(t, s, andrej.account,
+		[]SignedTx{andrej.signTx(babayaga.account, 0, 50, 0, "rent")},
+		[]SignedTx{babayaga.signTx(andrej.account, 0, 5, 0, "vodka"), babayaga.signTx(babayaga.account, 1, 1, 0, "savings")},
+	)
+	addTestBlocks(t, s, babayaga.account, []SignedTx{})
+	return s
+}
+
+// The block, direction and memo of each of the account's transactions
+func accountHistory(t *testing.T, s *State, account Account, direction TxDirection, offset int, limit int) ([]string, int) {
+	accountTxs, total, err := GetAccountTxs(account, direction, offset, limit, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := make([]string, 0, len(accountTxs))
+	for _, accountTx := range accountTxs {
+		history = append(history, fmt.Sprintf("%d %s %s", accountTx.BlockNumber, accountTx.Direction, accountTx.Tx.Data))
+	}
+	return history, total
+}
+
+func TestGetAccountTxs(t *testing.T) {
+	s := newTestAccountChain(t)
+	defer s.Close()
+
+	testCases := []struct {
+		name      string
+		direction TxDirection
+		offset    int
+		limit     int
+		want      []string
+		wantTotal int
+	}{
+		{"all", "", 0, 10, []string{"2 in reward", "1 self savings", "1 out vodka", "0 in rent"}, 4},
+		{"in", TxIn, 0, 10, []string{"2 in reward", "1 self savings", "0 in rent"}, 3},
+		{"out", TxOut, 0, 10, []string{"1 self savings", "1 out vodka"}, 2},
+		{"a page", "", 1, 2, []string{"1 self savings", "1 out vodka"}, 4},
+		{"past the end", "", 5, 2, []string{}, 4},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			history, total := accountHistory(t, s, babayaga.account, tc.direction, tc.offset, tc.limit)
+			if !reflect.DeepEqual(history, tc.want) || total != tc.wantTotal {
+				t.Errorf("got %v of %d; want %v of %d", history, total, tc.want, tc.wantTotal)
+			}
+		})
+	}
+}
+
+func TestGetBlockWithTx(t *testing.T) {
+	s := newTestAccountChain(t)
+	defer s.Close()
+
+	// Andrej mined the first two blocks, each reward is found in its own block
+	for height := uint64(0); height < s.NextBlockNumber(); height++ {
+		blockFs, err := GetBlockByHeight(height, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, tx := range blockFs.Value.TXs {
+			found, index, err := GetBlockWithTx(tx.Hash(), s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found.Key != blockFs.Key || index != i {
+				t.Errorf("found TX %d of block %d at %d of block '%s'", i, height, index, found.Key.Hex())
+			}
+			_, _, confirmations, err := GetBlockWithTxConfirmations(tx.Hash(), s)
+			if want := s.NextBlockNumber() - height; err != nil || confirmations != want {
+				t.Errorf("got %d confirmations of TX %d of block %d, %v; want %d", confirmations, i, height, err, want)
+			}
+		}
+	}
+
+	if _, _, err := GetBlockWithTx(andrej.signTx(babayaga.account, 9, 1, 0, "rent").Hash(), s); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("got %v; want %v", err, ErrTxNotFound)
+	}
+}
+
+func TestTxIndexFollowsTheBlocks(t *testing.T) {
+	s := newTestAccountChain(t)
+	want, _ := accountHistory(t, s, babayaga.account, "", 0, 10)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		damage func(path string) error
+	}{
+		{"as written", func(path string) error { return nil }},
+		{"missing", os.Remove},
+		{"partial record", func(path string) error {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.Write([]byte{0x01})
+			return err
+		}},
+		{"missing the latest block", func(path string) error {
+			r, err := LoadStateReadOnly(s.dataDir)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			return r.txs.truncate(r.txs.len() - 1)
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.damage(getTxIndexFilePath(s.dataDir)); err != nil {
+				t.Fatal(err)
+			}
+
+			reloaded, err := LoadStateFromDisk(s.dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reloaded.Close()
+
+			if got, _ := accountHistory(t, reloaded, babayaga.account, "", 0, 10); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v; want %v", got, want)
+			}
+			if _, err := readTxIndex(getTxIndexFilePath(s.dataDir), reloaded.blocks); err != nil {
+				t.Errorf("the transaction index wasn't rewritten: %s", err)
+			}
+		})
+	}
+}
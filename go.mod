@@ -1,5 +1,8 @@
 module simpleblockchain
 
-go 1.14
+go 1.16
 
-require github.com/spf13/cobra v1.0.0
+require (
+	github.com/spf13/cobra v1.0.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+)
@@ -21,6 +21,10 @@ func main() {
 	tbbCmd.AddCommand(cli.BalancesCmd())
 	tbbCmd.AddCommand(cli.RunCmd())
 	tbbCmd.AddCommand(cli.TxCmd())
+	tbbCmd.AddCommand(cli.WalletCmd())
+	tbbCmd.AddCommand(cli.ChainCmd())
+	tbbCmd.AddCommand(cli.GenesisCmd())
+	tbbCmd.AddCommand(cli.AccountCmd())
 
 	err := tbbCmd.Execute()
 	if err != nil {
@@ -1,11 +1,13 @@
 package node
 
 import (
+	"errors"
 	"fmt"
+	"math/big"
 	"net/http"
 	"simpleblockchain/dao"
 	"strconv"
-	"time"
+	"strings"
 )
 
 type ErrRes struct {
@@ -13,24 +15,89 @@ type ErrRes struct {
 }
 
 type BalancesRes struct {
-	Hash     dao.Hash     `json:"block_hash"`
-	Balances dao.Balances `json:"balances"`
+	Hash        dao.Hash     `json:"block_hash"`
+	BlockNumber uint64       `json:"block_number"`
+	Time        uint64       `json:"block_time"` // When the block was mined, in seconds since 1970
+	Balances    dao.Balances `json:"balances"`
 }
 
 type TxAddReq struct {
-	From  string `json:"from"`
-	To    string `json:"to"`
-	Value uint   `json:"value"`
-	Data  string `json:"data"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Nonce     uint64 `json:"nonce"`
+	Value     uint   `json:"value"`
+	Fee       uint   `json:"fee"`
+	Data      string `json:"data"`
+	PublicKey []byte `json:"public_key"`
+	Signature []byte `json:"signature"`
 }
 
 type TxAddRes struct {
-	Hash dao.Hash `json:"block_hash"`
+	Success bool     `json:"success"`
+	Hash    dao.Hash `json:"tx_hash"`
+}
+
+// The status of a transaction that is still in the mempool
+const TxStatusPending = "pending"
+
+// The status of a transaction that has been mined into a block
+const TxStatusConfirmed = "confirmed"
+
+type TxRes struct {
+	Hash          dao.Hash     `json:"tx_hash"`
+	Tx            dao.SignedTx `json:"tx"`
+	Status        string       `json:"status"`
+	BlockNumber   uint64       `json:"block_number"`
+	BlockHash     dao.Hash     `json:"block_hash"`
+	Confirmations uint64       `json:"confirmations"` // How many blocks have been mined from its block onwards
+}
+
+type AccountNonceRes struct {
+	Account dao.Account `json:"account"`
+	Nonce   uint64      `json:"nonce"`
+}
+
+// AccountTxRes is a transaction as seen by the account it's listed for
+type AccountTxRes struct {
+	BlockNumber  uint64          `json:"block_number"`
+	BlockHash    dao.Hash        `json:"block_hash"`
+	Time         uint64          `json:"block_time"`
+	TxHash       dao.Hash        `json:"tx_hash"`
+	Direction    dao.TxDirection `json:"direction"`
+	Counterparty dao.Account     `json:"counterparty"` // Who paid or was paid by the account, empty for a reward
+	Value        uint            `json:"value"`
+	Fee          uint            `json:"fee"`
+	Data         string          `json:"data"`
+}
+
+type AccountTxsRes struct {
+	Account dao.Account    `json:"account"`
+	Total   int            `json:"total"` // How many transactions the account has in the direction
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	TXs     []AccountTxRes `json:"txs"`
+}
+
+type TxPendingRes struct {
+	TXs []dao.SignedTx `json:"txs"`
+}
+
+type TxProofRes struct {
+	BlockHash dao.Hash        `json:"block_hash"`
+	Header    dao.BlockHeader `json:"header"`
+	Tx        dao.SignedTx    `json:"tx"`
+	Proof     dao.MerkleProof `json:"proof"`
+}
+
+type ChainSnapshotRes struct {
+	BlockNumber uint64   `json:"block_number"`
+	BlockHash   dao.Hash `json:"block_hash"`
 }
 
 type StatusRes struct {
 	Hash        dao.Hash            `json:"block_hash"`
 	BlockNumber uint64              `json:"block_number"`
+	TotalWork   *big.Int            `json:"total_work"`
 	KnownPeers  map[string]PeerNode `json:"peers_known"`
 }
 
@@ -43,8 +110,68 @@ type AddPeerRes struct {
 	Error   string `json:"error"`
 }
 
+// The latest balances, or those after the block in the query
 func listBalancesHandler(w http.ResponseWriter, r *http.Request, state *dao.State) {
-	writeRes(w, BalancesRes{state.LatestBlockHash(), state.Balances})
+	block := r.URL.Query().Get(EndpointBalancesListQueryKeyBlock)
+	hash := r.URL.Query().Get(EndpointBalancesListQueryKeyHash)
+
+	var res BalancesRes
+	var err error
+	switch {
+	case block != "" && hash != "":
+		writeErrResWithStatus(w, http.StatusBadRequest, fmt.Errorf("list the balances at a block or a hash, not both"))
+		return
+	case block != "":
+		height, parseErr := strconv.ParseUint(block, 10, 64)
+		if parseErr != nil {
+			writeErrResWithStatus(w, http.StatusBadRequest, fmt.Errorf("'%s' is not a block height", block))
+			return
+		}
+		res, err = BalancesAtHeight(height, state)
+	case hash != "":
+		blockHash := dao.Hash{}
+		if err := blockHash.UnmarshalText([]byte(hash)); err != nil || blockHash.IsEmpty() {
+			writeErrResWithStatus(w, http.StatusBadRequest, fmt.Errorf("'%s' is not a block hash", hash))
+			return
+		}
+		res, err = BalancesAtHash(blockHash, state)
+	default:
+		res = LatestBalances(state)
+	}
+	if errors.Is(err, dao.ErrBlockNotFound) {
+		writeErrResWithStatus(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, res)
+}
+
+// LatestBalances are the balances after the latest block
+func LatestBalances(state *dao.State) BalancesRes {
+	balances, blockFs := dao.GetLatestBalances(state)
+	return BalancesRes{blockFs.Key, blockFs.Value.Header.BlockNumber, blockFs.Value.Header.Time, balances}
+}
+
+// BalancesAtHeight are the balances as they were after the block at the height
+func BalancesAtHeight(height uint64, state *dao.State) (BalancesRes, error) {
+	balances, blockFs, err := dao.GetBalancesAtHeight(height, state)
+	if err != nil {
+		return BalancesRes{}, err
+	}
+	return BalancesRes{blockFs.Key, blockFs.Value.Header.BlockNumber, blockFs.Value.Header.Time, balances}, nil
+}
+
+// BalancesAtHash are the balances as they were after the block with the hash
+func BalancesAtHash(blockHash dao.Hash, state *dao.State) (BalancesRes, error) {
+	balances, blockFs, err := dao.GetBalancesAtHash(blockHash, state)
+	if err != nil {
+		return BalancesRes{}, err
+	}
+	return BalancesRes{blockFs.Key, blockFs.Value.Header.BlockNumber, blockFs.Value.Header.Time, balances}, nil
 }
 
 func txAddHandler(w http.ResponseWriter, r *http.Request, state *dao.State) {
@@ -55,29 +182,278 @@ func txAddHandler(w http.ResponseWriter, r *http.Request, state *dao.State) {
 		return
 	}
 
-	tx := dao.NewTx(dao.NewAccount(req.From), dao.NewAccount(req.To), req.Value, req.Data)
+	from, err := parseTxAccount("from", req.From)
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseTxAccount("to", req.To)
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx := dao.SignedTx{
+		Tx:        dao.NewTx(from, to, req.Nonce, req.Value, req.Fee, req.Data),
+		PublicKey: req.PublicKey,
+		Sig:       req.Signature,
+	}
+
+	txHash := tx.Hash()
+	err = state.AddTx(tx)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, TxAddRes{true, txHash})
+}
+
+// The transaction was signed with its addresses exactly as they were sent, so an address
+// in any other form than the one ParseAccount gives is refused rather than rewritten
+func parseTxAccount(field string, value string) (dao.Account, error) {
+	account, err := dao.ParseAccount(value)
+	if err != nil {
+		return "", fmt.Errorf("the %s %w", field, err)
+	}
+	if string(account) != value {
+		return "", fmt.Errorf("the %s address '%s' must be written in lower case, '%s'", field, value, account)
+	}
+	return account, nil
+}
+
+func txHandler(w http.ResponseWriter, r *http.Request, state *dao.State) {
+	if r.Method != http.MethodGet {
+		writeErrResWithStatus(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed", r.Method))
+		return
+	}
+
+	txHash := dao.Hash{}
+	err := txHash.UnmarshalText([]byte(strings.TrimPrefix(r.URL.Path, EndpointTx)))
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := FindTx(txHash, state)
+	if errors.Is(err, dao.ErrTxNotFound) {
+		writeErrResWithStatus(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
 
-	block := dao.NewBlock(
-		state.LatestBlockHash(),
-		state.NextBlockNumber(),
-		0,
-		uint64(time.Now().Unix()),
-		[]dao.Tx{tx},
-	)
+	writeRes(w, res)
+}
+
+// FindTx looks for the transaction in the mempool and then in the chain
+func FindTx(txHash dao.Hash, state *dao.State) (TxRes, error) {
+	if tx, ok := state.PendingTx(txHash); ok {
+		return TxRes{Hash: txHash, Tx: tx, Status: TxStatusPending}, nil
+	}
+
+	blockFs, index, confirmations, err := dao.GetBlockWithTxConfirmations(txHash, state)
+	if err != nil {
+		return TxRes{}, err
+	}
 
-	hash, err := state.AddBlock(block)
+	return TxRes{
+		Hash:          txHash,
+		Tx:            blockFs.Value.TXs[index],
+		Status:        TxStatusConfirmed,
+		BlockNumber:   blockFs.Value.Header.BlockNumber,
+		BlockHash:     blockFs.Key,
+		Confirmations: confirmations,
+	}, nil
+}
+
+// The nonce for the next transaction from the account, counting those in the mempool
+func accountNonceHandler(w http.ResponseWriter, r *http.Request, state *dao.State) {
+	account, err := dao.ParseAccount(r.URL.Query().Get(EndpointAccountNonceQueryKeyAccount))
 	if err != nil {
 		writeErrRes(w, err)
 		return
 	}
 
-	writeRes(w, TxAddRes{hash})
+	writeRes(w, AccountNonceRes{account, state.NextNonce(account)})
+}
+
+// The transactions of the account in the path, /accounts/{account}/txs
+func accountTxsHandler(w http.ResponseWriter, r *http.Request, state *dao.State) {
+	if r.Method != http.MethodGet {
+		writeErrResWithStatus(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed", r.Method))
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, EndpointAccounts)
+	if !strings.HasSuffix(path, EndpointAccountTxs) {
+		writeErrResWithStatus(w, http.StatusNotFound, fmt.Errorf("'%s' is not found", r.URL.Path))
+		return
+	}
+	account, err := dao.ParseAccount(strings.TrimSuffix(path, EndpointAccountTxs))
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := r.URL.Query()
+	offset, limit := 0, DefaultAccountTxsLimit
+	if raw := query.Get(EndpointAccountTxsQueryKeyOffset); raw != "" {
+		parsed, err := strconv.ParseUint(raw, 10, 31)
+		if err != nil {
+			writeErrResWithStatus(w, http.StatusBadRequest, fmt.Errorf("the offset '%s' must be a whole number", raw))
+			return
+		}
+		offset = int(parsed)
+	}
+	if raw := query.Get(EndpointAccountTxsQueryKeyLimit); raw != "" {
+		parsed, err := strconv.ParseUint(raw, 10, 31)
+		if err != nil || parsed == 0 || parsed > MaxAccountTxsLimit {
+			writeErrResWithStatus(w, http.StatusBadRequest, fmt.Errorf("the limit '%s' must be from 1 to %d", raw, MaxAccountTxsLimit))
+			return
+		}
+		limit = int(parsed)
+	}
+	direction, err := dao.ParseTxDirection(query.Get(EndpointAccountTxsQueryKeyDirection))
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := AccountTxs(account, direction, offset, limit, state)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, res)
+}
+
+// AccountTxs lists the transactions of the account in the direction, newest first
+func AccountTxs(account dao.Account, direction dao.TxDirection, offset int, limit int, state *dao.State) (AccountTxsRes, error) {
+	accountTxs, total, err := dao.GetAccountTxs(account, direction, offset, limit, state)
+	if err != nil {
+		return AccountTxsRes{}, err
+	}
+
+	res := AccountTxsRes{account, total, offset, limit, make([]AccountTxRes, 0, len(accountTxs))}
+	for _, accountTx := range accountTxs {
+		counterparty := accountTx.Tx.From
+		if accountTx.Direction != dao.TxIn {
+			counterparty = accountTx.Tx.To
+		}
+
+		res.TXs = append(res.TXs, AccountTxRes{
+			BlockNumber:  accountTx.BlockNumber,
+			BlockHash:    accountTx.BlockHash,
+			Time:         accountTx.Time,
+			TxHash:       accountTx.Tx.Hash(),
+			Direction:    accountTx.Direction,
+			Counterparty: counterparty,
+			Value:        accountTx.Tx.Value,
+			Fee:          accountTx.Tx.Fee,
+			Data:         accountTx.Tx.Data,
+		})
+	}
+
+	return res, nil
+}
+
+func txPendingHandler(w http.ResponseWriter, r *http.Request, state *dao.State) {
+	writeRes(w, TxPendingRes{state.PendingTXs()})
+}
+
+func txProofHandler(w http.ResponseWriter, r *http.Request, state *dao.State) {
+	txHash := dao.Hash{}
+	err := txHash.UnmarshalText([]byte(r.URL.Query().Get(EndpointTxProofQueryKeyTx)))
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	res, err := TxProof(txHash, state)
+	if errors.Is(err, dao.ErrTxNotFound) {
+		writeErrResWithStatus(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, res)
+}
+
+// TxProof proves a transaction is in the chain with just the header of its block
+func TxProof(txHash dao.Hash, state *dao.State) (TxProofRes, error) {
+	blockFs, index, err := dao.GetBlockWithTx(txHash, state)
+	if err != nil {
+		return TxProofRes{}, err
+	}
+
+	proof, err := dao.NewMerkleProof(blockFs.Value.TXs, index)
+	if err != nil {
+		return TxProofRes{}, err
+	}
+
+	return TxProofRes{blockFs.Key, blockFs.Value.Header, blockFs.Value.TXs[index], proof}, nil
+}
+
+// A block is found by its hash, anything shorter is the height of the block
+func blockHandler(w http.ResponseWriter, r *http.Request, state *dao.State) {
+	if r.Method != http.MethodGet {
+		writeErrResWithStatus(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed", r.Method))
+		return
+	}
+
+	var blockFs dao.BlockFS
+	var err error
+	key := strings.TrimPrefix(r.URL.Path, EndpointBlock)
+	if height, parseErr := strconv.ParseUint(key, 10, 64); parseErr == nil && len(key) < len(dao.Hash{})*2 {
+		blockFs, err = dao.GetBlockByHeight(height, state)
+	} else {
+		blockHash := dao.Hash{}
+		if err := blockHash.UnmarshalText([]byte(key)); err != nil || blockHash.IsEmpty() {
+			writeErrResWithStatus(w, http.StatusBadRequest, fmt.Errorf("'%s' is neither a block height nor a block hash", key))
+			return
+		}
+		blockFs, err = dao.GetBlockByHash(blockHash, state)
+	}
+	if errors.Is(err, dao.ErrBlockNotFound) {
+		writeErrResWithStatus(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, blockFs)
+}
+
+func chainSnapshotHandler(w http.ResponseWriter, r *http.Request, state *dao.State) {
+	if r.Method != http.MethodPost {
+		writeErrResWithStatus(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed", r.Method))
+		return
+	}
+
+	blockFs, err := state.Snapshot()
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, ChainSnapshotRes{blockFs.Value.Header.BlockNumber, blockFs.Key})
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	tip := node.state.Tip()
 	res := StatusRes{
-		Hash:        node.state.LatestBlockHash(),
-		BlockNumber: node.state.LatestBlock().Header.BlockNumber,
+		Hash:        tip.Latest.Key,
+		BlockNumber: tip.Latest.Value.Header.BlockNumber,
+		TotalWork:   tip.TotalWork,
 		KnownPeers:  node.knownPeers,
 	}
 
@@ -95,6 +471,10 @@ func syncHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 	}
 
 	blocks, err := dao.GetBlocksAfter(hash, node.state)
+	if errors.Is(err, dao.ErrBlockNotFound) {
+		writeErrResWithStatus(w, http.StatusNotFound, err)
+		return
+	}
 	if err != nil {
 		writeErrRes(w, err)
 		return
@@ -0,0 +1,126 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"simpleblockchain/dao"
+	"strings"
+	"testing"
+)
+
+func TestHandlers(t *testing.T) {
+	state, sender, privateKey := newTestState(t)
+	defer state.Close()
+
+	// Two blocks, the first transaction is in block 0 and the second in block 1
+	txs := []dao.SignedTx{
+		dao.NewSignedTx(dao.NewTx(sender, sender, 0, 10, dao.DefaultMinFee, ""), privateKey),
+		dao.NewSignedTx(dao.NewTx(sender, sender, 1, 10, dao.DefaultMinFee, ""), privateKey),
+	}
+	block0 := addTestBlock(t, state, sender, txs[:1])
+	addTestBlock(t, state, sender, txs[1:])
+
+	unknown := dao.Hash{0xab}
+	accountTxs := fmt.Sprintf("%s%s%s", EndpointAccounts, sender, EndpointAccountTxs)
+
+	testCases := []struct {
+		target  string
+		handler func(http.ResponseWriter, *http.Request, *dao.State)
+		status  int
+	}{
+		{EndpointTx + txs[0].Hash().Hex(), txHandler, http.StatusOK},
+		{EndpointTx + unknown.Hex(), txHandler, http.StatusNotFound},
+		{EndpointTx + "not-a-hash", txHandler, http.StatusBadRequest},
+
+		{EndpointBlock + "1", blockHandler, http.StatusOK},
+		{EndpointBlock + block0.Hex(), blockHandler, http.StatusOK},
+		{EndpointBlock + "2", blockHandler, http.StatusNotFound},
+		{EndpointBlock + unknown.Hex(), blockHandler, http.StatusNotFound},
+		{EndpointBlock + "not-a-block", blockHandler, http.StatusBadRequest},
+
+		{EndpointBalancesList + "?block=0", listBalancesHandler, http.StatusOK},
+		{EndpointBalancesList + "?hash=" + block0.Hex(), listBalancesHandler, http.StatusOK},
+		{EndpointBalancesList + "?block=2", listBalancesHandler, http.StatusNotFound},
+		{EndpointBalancesList + "?hash=" + unknown.Hex(), listBalancesHandler, http.StatusNotFound},
+		{EndpointBalancesList + "?block=first", listBalancesHandler, http.StatusBadRequest},
+		{EndpointBalancesList + "?hash=not-a-hash", listBalancesHandler, http.StatusBadRequest},
+		{EndpointBalancesList + "?block=0&hash=" + block0.Hex(), listBalancesHandler, http.StatusBadRequest},
+
+		{accountTxs + "?offset=1&limit=1&direction=out", accountTxsHandler, http.StatusOK},
+		{EndpointAccounts + string(sender), accountTxsHandler, http.StatusNotFound},
+		{EndpointAccounts + "tim" + EndpointAccountTxs, accountTxsHandler, http.StatusBadRequest},
+		{accountTxs + "?offset=-1", accountTxsHandler, http.StatusBadRequest},
+		{accountTxs + "?limit=0", accountTxsHandler, http.StatusBadRequest},
+		{accountTxs + fmt.Sprintf("?limit=%d", MaxAccountTxsLimit+1), accountTxsHandler, http.StatusBadRequest},
+		{accountTxs + "?direction=sideways", accountTxsHandler, http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.handler(w, httptest.NewRequest(http.MethodGet, tc.target, nil), state)
+			if w.Code != tc.status {
+				t.Errorf("got %d %s; want %d", w.Code, w.Body, tc.status)
+			}
+		})
+	}
+}
+
+func TestTxHandlerCountsConfirmations(t *testing.T) {
+	state, sender, privateKey := newTestState(t)
+	defer state.Close()
+
+	txs := []dao.SignedTx{
+		dao.NewSignedTx(dao.NewTx(sender, sender, 0, 10, dao.DefaultMinFee, ""), privateKey),
+		dao.NewSignedTx(dao.NewTx(sender, sender, 1, 10, dao.DefaultMinFee, ""), privateKey),
+	}
+	addTestBlock(t, state, sender, txs[:1])
+	addTestBlock(t, state, sender, txs[1:])
+
+	w := httptest.NewRecorder()
+	txHandler(w, httptest.NewRequest(http.MethodGet, EndpointTx+txs[0].Hash().Hex(), nil), state)
+
+	res := TxRes{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != TxStatusConfirmed || res.BlockNumber != 0 || res.Confirmations != 2 {
+		t.Errorf("got %s in block %d with %d confirmations; want %s in block 0 with 2", res.Status, res.BlockNumber, res.Confirmations, TxStatusConfirmed)
+	}
+}
+
+func TestTxAddHandlerChecksTheAddresses(t *testing.T) {
+	state, sender, privateKey := newTestState(t)
+	defer state.Close()
+
+	mixedCase := dao.AddressPrefix + strings.ToUpper(string(sender[len(dao.AddressPrefix):]))
+	testCases := []struct {
+		name   string
+		from   string
+		to     string
+		status int
+	}{
+		{"lower case", string(sender), string(sender), http.StatusOK},
+		{"to in upper case", string(sender), mixedCase, http.StatusBadRequest},
+		{"from in upper case", mixedCase, string(sender), http.StatusBadRequest},
+		{"from a name", "andrej", string(sender), http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Signed as the client sent it, the addresses aren't rewritten first
+			tx := dao.NewSignedTx(dao.NewTx(dao.NewAccount(tc.from), dao.NewAccount(tc.to), 0, 10, dao.DefaultMinFee, ""), privateKey)
+			req, err := json.Marshal(TxAddReq{tc.from, tc.to, 0, 10, dao.DefaultMinFee, "", tx.PublicKey, tx.Sig})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			txAddHandler(w, httptest.NewRequest(http.MethodPost, EndpointTxAdd, bytes.NewReader(req)), state)
+			if w.Code != tc.status {
+				t.Errorf("got %d %s; want %d", w.Code, w.Body, tc.status)
+			}
+		})
+	}
+}
@@ -2,15 +2,23 @@ package node
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 )
 
+// errNotFound is returned when a peer replies that it doesn't have what was asked for
+var errNotFound = errors.New("not found")
+
 func writeErrRes(w http.ResponseWriter, err error) {
+	writeErrResWithStatus(w, http.StatusInternalServerError, err)
+}
+
+func writeErrResWithStatus(w http.ResponseWriter, status int, err error) {
 	jsonErrRes, _ := json.Marshal(ErrRes{err.Error()})
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(status)
 	_, _ = w.Write(jsonErrRes)
 }
 
@@ -48,6 +56,15 @@ func readRes(r *http.Response, reqBody interface{}) error {
 	}
 	defer r.Body.Close()
 
+	if r.StatusCode != http.StatusOK {
+		errRes := ErrRes{}
+		_ = json.Unmarshal(reqBodyJson, &errRes)
+		if r.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s", errNotFound, errRes.Error)
+		}
+		return fmt.Errorf("peer replied with %s: %s", r.Status, errRes.Error)
+	}
+
 	err = json.Unmarshal(reqBodyJson, reqBody)
 	if err != nil {
 		return fmt.Errorf("unable to unmarshal response body. %s", err.Error())
@@ -0,0 +1,190 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"simpleblockchain/dao"
+	"time"
+)
+
+// How often the miner reports on its progress
+const miningProgressInterval = 1000000
+
+// How often the node checks the mempool for transactions to mine
+var miningInterval = 10 * time.Second
+
+// Mines each pending block, the tests replace it to control when mining finishes
+var mineBlock = Mine
+
+// The most transactions the node mines into one block
+// The rest wait in the mempool for a later block
+const maxBlockTXs = 100
+
+// PendingBlock is a block waiting to be mined
+// It has everything except a nonce that produces a valid hash
+type PendingBlock struct {
+	parent     dao.Hash
+	number     uint64
+	time       uint64
+	difficulty uint32
+	miner      dao.Account
+	reward     uint
+	txs        []dao.SignedTx
+}
+
+// NewPendingBlock prepares the next block on top of the state
+// The miner will be rewarded with the full block reward
+func NewPendingBlock(s *dao.State, miner dao.Account, txs []dao.SignedTx) PendingBlock {
+	// Everything is read from the same tip, even if a peer adds a block meanwhile
+	tip := s.Tip()
+
+	// The block must be later than the median time of the latest blocks
+	blockTime := uint64(time.Now().Unix())
+	if blockTime <= tip.MedianTime {
+		blockTime = tip.MedianTime + 1
+	}
+
+	return PendingBlock{
+		parent:     tip.Parent,
+		number:     tip.Number,
+		time:       blockTime,
+		difficulty: tip.Difficulty,
+		miner:      miner,
+		reward:     tip.Reward,
+		txs:        txs,
+	}
+}
+
+// Mine searches for a nonce that makes the block hash valid
+//
+// The nonce is incremented on every attempt, when all the nonces have been tried
+// the time is moved on a second and the nonce starts again.
+// Mining stops as soon as the context is cancelled.
+func Mine(ctx context.Context, pb PendingBlock) (dao.Block, error) {
+	if len(pb.txs) == 0 {
+		return dao.Block{}, fmt.Errorf("mining empty blocks is not allowed")
+	}
+	if pb.miner == "" {
+		return dao.Block{}, fmt.Errorf("a miner is needed to reward")
+	}
+
+	// The coinbase must be the first transaction in the block
+	txs := append([]dao.SignedTx{dao.NewCoinbaseTx(pb.miner, pb.reward, pb.number)}, pb.txs...)
+
+	start := time.Now()
+	attempt := uint64(0)
+	blockTime := pb.time
+	nonce := uint32(0)
+
+	block := dao.NewBlock(pb.parent, pb.number, nonce, blockTime, pb.difficulty, pb.miner, txs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Printf("Mining of block %d cancelled after %d attempts in %s\n", pb.number, attempt, time.Since(start))
+			return dao.Block{}, ctx.Err()
+		default:
+		}
+
+		attempt++
+		block.Header.Nonce = nonce
+		block.Header.Time = blockTime
+		hash := block.Hash()
+		if dao.IsBlockHashValid(hash, pb.difficulty) {
+			fmt.Printf("Mined block %d '%s' after %d attempts in %s\n", pb.number, hash.Hex(), attempt, time.Since(start))
+			return block, nil
+		}
+
+		if attempt%miningProgressInterval == 0 {
+			fmt.Printf("Mining block %d: %d attempts in %s\n", pb.number, attempt, time.Since(start))
+		}
+
+		// When the nonce wraps around we have run out of nonces for this time
+		nonce++
+		if nonce == 0 {
+			blockTime++
+		}
+	}
+}
+
+// The node batches up the pending transactions in the mempool into a block every miningInterval
+//
+// Only one block is mined at a time. When a peer moves the chain on whilst a block is
+// being mined the block is stale, so mining is cancelled and restarted on the new tip
+// with whatever is left in the mempool.
+func (n *Node) mine(ctx context.Context) error {
+	ticker := time.NewTicker(miningInterval)
+	defer ticker.Stop()
+
+	var stopMining context.CancelFunc // Set whilst a block is being mined
+	restart := false
+	mined := make(chan error, 1)
+
+	startMining := func() {
+		if stopMining != nil || len(n.state.PendingTXs()) == 0 {
+			return
+		}
+		var miningCtx context.Context
+		miningCtx, stopMining = context.WithCancel(ctx)
+		go func() {
+			mined <- n.minePendingTXs(miningCtx)
+		}()
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			startMining()
+
+		case tip := <-n.newTip:
+			if stopMining != nil {
+				fmt.Printf("Peer moved the chain on to '%s', restarting mining\n", tip.Hex())
+				stopMining()
+				restart = true
+			}
+
+		case err := <-mined:
+			stopMining()
+			stopMining = nil
+			if err != nil && !errors.Is(err, context.Canceled) {
+				fmt.Printf("ERROR: %s\n", err)
+			}
+			if restart {
+				restart = false
+				startMining()
+			}
+
+		case <-ctx.Done():
+			if stopMining != nil {
+				stopMining()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+func (n *Node) minePendingTXs(ctx context.Context) error {
+	// The best paying transactions are first
+	pendingTXs := n.state.PendingTXs()
+	if len(pendingTXs) == 0 {
+		return nil
+	}
+	if len(pendingTXs) > maxBlockTXs {
+		pendingTXs = pendingTXs[:maxBlockTXs]
+	}
+
+	pendingBlock := NewPendingBlock(n.state, n.miner, pendingTXs)
+
+	block, err := mineBlock(ctx, pendingBlock)
+	if err != nil {
+		return fmt.Errorf("Cannot mine block %d: %w", pendingBlock.number, err)
+	}
+
+	_, err = n.state.AddBlock(block)
+	if err != nil {
+		return fmt.Errorf("Cannot add mined block %d: %w", pendingBlock.number, err)
+	}
+
+	return nil
+}
@@ -1,27 +1,36 @@
 package node
 
 import (
+	"context"
+	"crypto/ed25519"
 	"encoding/hex"
 	"fmt"
+	"reflect"
 	"simpleblockchain/dao"
 	"testing"
+	"time"
 )
 
 func TestIsBlockHashValid(t *testing.T) {
 	testCases := []struct {
-		hexHash string
-		want    bool
+		hexHash    string
+		difficulty uint32
+		want       bool
 	}{
-		{"000000fa04f816039...a4db586086168edfa", true},
-		{"123450fa04f816039...a4db586086168edfa", false},
+		{"000000fa04f816039...a4db586086168edfa", 16, true},
+		{"000000fa04f816039...a4db586086168edfa", 24, true},
+		{"000000fa04f816039...a4db586086168edfa", 25, false},
+		{"123450fa04f816039...a4db586086168edfa", 16, false},
+		{"123450fa04f816039...a4db586086168edfa", 3, true},
+		{"123450fa04f816039...a4db586086168edfa", 4, false},
 	}
 	for _, tc := range testCases {
-		t.Run(fmt.Sprintf("%s is %t", tc.hexHash, tc.want), func(t *testing.T) {
+		t.Run(fmt.Sprintf("%s at %d is %t", tc.hexHash, tc.difficulty, tc.want), func(t *testing.T) {
 			var hash = dao.Hash{}
 			// Convert it to raw bytes
 			hex.Decode(hash[:], []byte(tc.hexHash))
 			// Check the validity of the hash
-			if got := dao.IsBlockHashValid(hash); got != tc.want {
+			if got := dao.IsBlockHashValid(hash, tc.difficulty); got != tc.want {
 				t.Errorf("got %t; want %t", got, tc.want)
 			}
 		})
@@ -40,6 +49,170 @@ func BenchmarkIsBlockHashValid(b *testing.B) {
 	// Convert it to raw bytes
 	hex.Decode(hash[:], []byte(hexHash))
 	for i := 0; i < b.N; i++ {
-		dao.IsBlockHashValid(hash)
+		dao.IsBlockHashValid(hash, dao.DefaultDifficulty)
+	}
+}
+
+func TestMine(t *testing.T) {
+	pendingBlock := newTestPendingBlock([]dao.SignedTx{{Tx: dao.NewTx("andrej", "babayaga", 0, 1, 0, "vodka")}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	block, err := Mine(ctx, pendingBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := block.Hash()
+	if !dao.IsBlockHashValid(hash, block.Header.Difficulty) {
+		t.Errorf("mined block hash %s is not valid", hash.Hex())
+	}
+
+	coinbase := block.TXs[0]
+	if len(block.TXs) != 2 || !reflect.DeepEqual(coinbase, dao.NewCoinbaseTx(block.Header.Miner, dao.DefaultBlockReward, block.Header.BlockNumber)) {
+		t.Errorf("mined block %v should start with a coinbase to the miner", block)
+	}
+}
+
+func TestMineCancelled(t *testing.T) {
+	pendingBlock := newTestPendingBlock([]dao.SignedTx{{Tx: dao.NewTx("andrej", "babayaga", 0, 1, 0, "vodka")}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := Mine(ctx, pendingBlock); err != context.Canceled {
+		t.Errorf("got %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestMineEmptyBlock(t *testing.T) {
+	if _, err := Mine(context.Background(), newTestPendingBlock(nil)); err == nil {
+		t.Error("mining an empty block should fail")
+	}
+}
+
+func newTestPendingBlock(txs []dao.SignedTx) PendingBlock {
+	return PendingBlock{
+		parent:     dao.Hash{},
+		number:     0,
+		time:       uint64(time.Now().Unix()),
+		difficulty: dao.DefaultDifficulty,
+		miner:      "andrej",
+		reward:     dao.DefaultBlockReward,
+		txs:        txs,
+	}
+}
+
+func TestMineRestartsOnANewTip(t *testing.T) {
+	state, sender, privateKey := newTestState(t)
+	defer state.Close()
+
+	txs := []dao.SignedTx{
+		dao.NewSignedTx(dao.NewTx(sender, sender, 0, 10, dao.DefaultMinFee, ""), privateKey),
+		dao.NewSignedTx(dao.NewTx(sender, sender, 1, 10, dao.DefaultMinFee, ""), privateKey),
+	}
+	for _, tx := range txs {
+		if err := state.AddTx(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Mining only finishes when it's cancelled, so the test decides when the chain moves on
+	attempts := make(chan miningAttempt, 2)
+	defer func(interval time.Duration, mine func(context.Context, PendingBlock) (dao.Block, error)) {
+		miningInterval, mineBlock = interval, mine
+	}(miningInterval, mineBlock)
+	miningInterval = 10 * time.Millisecond
+	mineBlock = func(ctx context.Context, pb PendingBlock) (dao.Block, error) {
+		attempts <- miningAttempt{ctx, pb}
+		<-ctx.Done()
+		return dao.Block{}, ctx.Err()
+	}
+
+	n := New(state, DefaultIP, DefaultHTTPort, "miner", PeerNode{})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- n.mine(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	first := nextAttempt(t, attempts)
+	if first.pb.parent != state.GenesisHash() || first.pb.number != 0 {
+		t.Fatalf("mining started on block %d after '%s'; want block 0 after the genesis", first.pb.number, first.pb.parent.Hex())
+	}
+
+	// A peer mines the first transaction into block 0
+	tip := addTestBlock(t, state, "peer", txs[:1])
+	n.signalNewTip(tip)
+
+	select {
+	case <-first.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("mining the stale block wasn't cancelled")
+	}
+
+	second := nextAttempt(t, attempts)
+	if second.pb.parent != tip || second.pb.number != 1 {
+		t.Errorf("mining restarted on block %d after '%s'; want block 1 after '%s'", second.pb.number, second.pb.parent.Hex(), tip.Hex())
+	}
+	if !reflect.DeepEqual(second.pb.txs, txs[1:]) {
+		t.Errorf("mining restarted with %v; want the TX left in the mempool %v", second.pb.txs, txs[1:])
+	}
+}
+
+// A state of a new chain that keeps its blocks in memory, with an account holding 100 that can sign
+// The difficulty is 1 so blocks are mined straight away.
+func newTestState(t *testing.T) (*dao.State, dao.Account, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := dao.NewAccountFromPublicKey(publicKey)
+
+	dataDir := t.TempDir()
+	gen := dao.NewGenesis("tbb-test", dao.Balances{account: 100})
+	gen.Difficulty = 1
+	if _, err := dao.WriteGenesis(dataDir, gen); err != nil {
+		t.Fatal(err)
+	}
+	state, err := dao.LoadStateWithStore(dataDir, dao.StoreMemory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, account, privateKey
+}
+
+// Mine a block with the transactions on top of the state and add it
+func addTestBlock(t *testing.T, state *dao.State, miner dao.Account, txs []dao.SignedTx) dao.Hash {
+	block, err := Mine(context.Background(), NewPendingBlock(state, miner, txs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := state.AddBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// A block the node started mining and the context that cancels it
+type miningAttempt struct {
+	ctx context.Context
+	pb  PendingBlock
+}
+
+func nextAttempt(t *testing.T, attempts chan miningAttempt) miningAttempt {
+	t.Helper()
+	select {
+	case next := <-attempts:
+		return next
+	case <-time.After(5 * time.Second):
+		t.Fatal("the node didn't start mining")
+		return miningAttempt{}
 	}
 }
@@ -21,7 +21,36 @@ const endpointAddPeerQueryKeyIP = "ip"
 const endpointAddPeerQueryKeyPort = "port"
 
 const EndpointBalancesList = "/balances/list"
+
+// The balances after an earlier block are listed with its height, ?block=N, or its hash, ?hash=H
+const EndpointBalancesListQueryKeyBlock = "block"
+const EndpointBalancesListQueryKeyHash = "hash"
 const EndpointTxAdd = "/tx/add"
+const EndpointTxPending = "/tx/pending"
+const EndpointTxProof = "/tx/proof"
+const EndpointTxProofQueryKeyTx = "tx"
+
+// A transaction is looked up by adding its hash to the end, /tx/{hash}
+const EndpointTx = "/tx/"
+
+// A block is looked up by adding its height or hash to the end, /block/{height|hash}
+const EndpointBlock = "/block/"
+
+const EndpointChainSnapshot = "/chain/snapshot"
+
+const EndpointAccountNonce = "/account/nonce"
+const EndpointAccountNonceQueryKeyAccount = "account"
+
+// The transactions of an account are listed with /accounts/{account}/txs, newest first
+const EndpointAccounts = "/accounts/"
+const EndpointAccountTxs = "/txs"
+const EndpointAccountTxsQueryKeyOffset = "offset"
+const EndpointAccountTxsQueryKeyLimit = "limit"
+const EndpointAccountTxsQueryKeyDirection = "direction"
+
+// How many transactions of an account are listed when the limit isn't given, and at most
+const DefaultAccountTxsLimit = 20
+const MaxAccountTxsLimit = 100
 
 type PeerNode struct {
 	IP          string `json:"ip"`
@@ -41,11 +70,14 @@ type Node struct {
 	port uint64
 
 	state *dao.State
+	miner dao.Account // The account rewarded for the blocks this node mines, no mining if empty
 
 	knownPeers map[string]PeerNode
+
+	newTip chan dao.Hash // Signals the miner when a peer has moved the chain on
 }
 
-func New(s *dao.State, ip string, port uint64, bootstrap PeerNode) *Node {
+func New(s *dao.State, ip string, port uint64, miner dao.Account, bootstrap PeerNode) *Node {
 	knownPeers := make(map[string]PeerNode)
 	knownPeers[bootstrap.TcpAddress()] = bootstrap
 
@@ -53,7 +85,9 @@ func New(s *dao.State, ip string, port uint64, bootstrap PeerNode) *Node {
 		state:      s,
 		ip:         ip,
 		port:       port,
+		miner:      miner,
 		knownPeers: knownPeers,
+		newTip:     make(chan dao.Hash, 1),
 	}
 }
 
@@ -66,6 +100,12 @@ func (n *Node) Run() error {
 	fmt.Println(fmt.Sprintf("Listening on: %s:%d", n.ip, n.port))
 
 	go n.sync(ctx)
+	if n.miner != "" {
+		fmt.Printf("Mining blocks for: %s\n", n.miner)
+		go n.mine(ctx)
+	} else {
+		fmt.Println("No miner account, this node won't mine blocks")
+	}
 
 	http.HandleFunc(EndpointBalancesList, func(w http.ResponseWriter, r *http.Request) {
 		listBalancesHandler(w, r, n.state)
@@ -75,6 +115,34 @@ func (n *Node) Run() error {
 		txAddHandler(w, r, n.state)
 	})
 
+	http.HandleFunc(EndpointTxPending, func(w http.ResponseWriter, r *http.Request) {
+		txPendingHandler(w, r, n.state)
+	})
+
+	http.HandleFunc(EndpointTxProof, func(w http.ResponseWriter, r *http.Request) {
+		txProofHandler(w, r, n.state)
+	})
+
+	http.HandleFunc(EndpointTx, func(w http.ResponseWriter, r *http.Request) {
+		txHandler(w, r, n.state)
+	})
+
+	http.HandleFunc(EndpointBlock, func(w http.ResponseWriter, r *http.Request) {
+		blockHandler(w, r, n.state)
+	})
+
+	http.HandleFunc(EndpointChainSnapshot, func(w http.ResponseWriter, r *http.Request) {
+		chainSnapshotHandler(w, r, n.state)
+	})
+
+	http.HandleFunc(EndpointAccountNonce, func(w http.ResponseWriter, r *http.Request) {
+		accountNonceHandler(w, r, n.state)
+	})
+
+	http.HandleFunc(EndpointAccounts, func(w http.ResponseWriter, r *http.Request) {
+		accountTxsHandler(w, r, n.state)
+	})
+
 	http.HandleFunc(endpointStatus, func(w http.ResponseWriter, r *http.Request) {
 		statusHandler(w, r, n)
 	})
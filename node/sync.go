@@ -2,6 +2,7 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"simpleblockchain/dao"
@@ -18,6 +19,7 @@ func (n *Node) sync(ctx context.Context) error {
 
 		case <-ctx.Done():
 			ticker.Stop()
+			return ctx.Err()
 		}
 	}
 }
@@ -64,36 +66,87 @@ func (n *Node) doSync() {
 }
 
 func (n *Node) syncBlocks(peer PeerNode, status StatusRes) error {
-	localBlockNumber := n.state.LatestBlock().Header.BlockNumber
-
 	// If the peer has no blocks, ignore it
 	if status.Hash.IsEmpty() {
 		return nil
 	}
 
-	// If the peer has less blocks than us, ignore it
-	if status.BlockNumber < localBlockNumber {
+	// Only follow the peer when its chain has more work than ours
+	if status.TotalWork == nil || status.TotalWork.Cmp(n.state.TotalWork()) <= 0 {
 		return nil
 	}
 
-	// If it's the genesis block and we already synced it, ignore it
-	if status.BlockNumber == 0 && !n.state.LatestBlockHash().IsEmpty() {
-		return nil
+	forkPoint, blocks, err := n.fetchBranchFromPeer(peer)
+	if err != nil {
+		return err
 	}
+	fmt.Printf("Found %d new blocks from Peer %s after block '%s'\n", len(blocks), peer.TcpAddress(), forkPoint.Hex())
 
-	// Display found 1 new block if we sync the genesis block 0
-	newBlocksCount := status.BlockNumber - localBlockNumber
-	if localBlockNumber == 0 && status.BlockNumber == 0 {
-		newBlocksCount = 1
+	err = n.state.AddBranch(forkPoint, blocks)
+	if err != nil {
+		return fmt.Errorf("Rejected blocks from Peer %s: %w", peer.TcpAddress(), err)
 	}
-	fmt.Printf("Found %d new blocks from Peer %s\n", newBlocksCount, peer.TcpAddress())
 
-	blocks, err := fetchBlocksFromPeer(peer, n.state.LatestBlockHash())
-	if err != nil {
-		return err
+	n.signalNewTip(n.state.LatestBlockHash())
+
+	return nil
+}
+
+// Let the miner know the chain has moved on without blocking sync
+// If the miner hasn't picked up an earlier tip yet then that one is replaced
+func (n *Node) signalNewTip(tip dao.Hash) {
+	for {
+		select {
+		case n.newTip <- tip:
+			return
+		default:
+		}
+
+		select {
+		case <-n.newTip:
+		default:
+		}
+	}
+}
+
+// Find the latest block we have in common with the peer and fetch the peer's blocks after it
+//
+// Our latest block is tried first, then we step back through our chain taking
+// bigger and bigger steps until the peer recognises a block. If it doesn't recognise
+// any of them the peer's whole chain is fetched.
+func (n *Node) fetchBranchFromPeer(peer PeerNode) (dao.Hash, []dao.Block, error) {
+	latest := n.state.Tip().Latest
+	forkPoint := latest.Key
+	height := latest.Value.Header.BlockNumber
+	step := uint64(1)
+
+	for !forkPoint.IsEmpty() {
+		blocks, err := fetchBlocksFromPeer(peer, forkPoint)
+		if err == nil {
+			return forkPoint, blocks, nil
+		}
+		if !errors.Is(err, errNotFound) {
+			return dao.Hash{}, nil, err
+		}
+
+		if height == 0 {
+			break
+		}
+		if step > height {
+			step = height
+		}
+		height -= step
+		step *= 2
+
+		blockFs, err := dao.GetBlockByHeight(height, n.state)
+		if err != nil {
+			return dao.Hash{}, nil, err
+		}
+		forkPoint = blockFs.Key
 	}
 
-	return n.state.AddBlocks(blocks)
+	blocks, err := fetchBlocksFromPeer(peer, dao.Hash{})
+	return dao.Hash{}, blocks, err
 }
 
 // Why are we passing peerNode in here?
@@ -0,0 +1,10 @@
+// Package static holds the files compiled into the tbb binary
+// so it runs from any directory
+package static
+
+import "embed"
+
+// Templates holds the text templates, the genesis file is the "genesis" template
+//
+//go:embed tmpl
+var Templates embed.FS
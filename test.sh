@@ -51,8 +51,30 @@ for d in $datad/*/; do
 done
 
 showDoCmd "./tbb version" $CYAN$'\n'
+
+# Every account has a key pair in the keystore, the passphrase is read from stdin as this isn't a terminal
+passphrase="tbb"
+## new_account prints the address of the new account
+new_account () {
+  printf "$passphrase\n$passphrase\n" | ./tbb wallet new 2>/dev/null | awk '/^New account/{print $3}'
+}
+echo $CYAN"Creating the accounts"
+andrej=$(new_account)
+babayaga=$(new_account)
+caesar=$(new_account)
+echo "andrej   $andrej"
+echo "babayaga $babayaga"
+echo "caesar   $caesar"
+
+# The genesis gives Andrej the first tokens
+showDoCmd "./tbb genesis init --chain-id=the-blockchain-bar-ledger --alloc=$andrej=10000 --difficulty=12" $CYAN
 showDoCmd "./tbb balances list" $YELLOW$'\n'
 
+## tx_add 1:datadir 2:from 3:to 4:value 5:data 6:colour, mined by andrej when no node is running
+tx_add () {
+  showDoCmd "echo $passphrase | ./tbb tx add --datadir=$1 --from=$2 --to=$3 --value=$4 --data=$5 --miner=$andrej" $6
+}
+
 if [ $# -eq 0 ];then exit;fi
 
 chapter=$1
@@ -64,26 +86,22 @@ fi
 if [ $chapter -ge 3 ]; then
   echo $WHITE"Running Chapter 3 - First customer"
   ## Andrej purchases 3 shots of vodka from his own bar
-  showDoCmd "./tbb tx add --from=andrej --to=andrej --value=3 --data=vodka" ${POWDER_BLUE}
+  tx_add $datad $andrej $andrej 3 vodka ${POWDER_BLUE}
   if [ $chapter -eq 3 ]; then showDoCmd "./tbb balances list";fi
 
-  # Andrej also decides he should be getting 100 tokens per day for maintaining
-  # the database and having such a brilliant disruptive idea. (700 per week)
-  showDoCmd "./tbb tx add --from=andrej --to=andrej --value=700 --data=reward" ${POWDER_BLUE}
-  if [ $chapter -eq 3 ]; then showDoCmd "./tbb balances list";fi
+  # Andrej no longer rewards himself, he is rewarded for mining every block
+  # that maintains the database.
 
   # To bring traffic to his bar, Andrej announces an exclusive 100% bonus for everyone who
   # purchases the TBB tokens in the next 24 hours.
   # Bingo! He gets his first customer called BabaYaga. BabaYaga pre-purchases 1000€ worth of tokens
-  showDoCmd "./tbb tx add --from=andrej --to=babayaga --value=2000  --data=1000€" ${LIME_YELLOW}
+  tx_add $datad $andrej $babayaga 2000 1000€ ${LIME_YELLOW}
   if [ $chapter -eq 3 ]; then showDoCmd "./tbb balances list";fi
 
   # She immediately spends 1 TBB for a vodka shot.
-  showDoCmd "./tbb tx add --from=babayaga --to=andrej --value=1 --data=vodka" ${LIME_YELLOW}
+  tx_add $datad $babayaga $andrej 1 vodka ${LIME_YELLOW}
   if [ $chapter -eq 3 ]; then showDoCmd "./tbb balances list";fi
 
-  # Another rewarding day
-  showDoCmd "./tbb tx add --from=andrej --to=andrej --value=100 --data=reward" ${POWDER_BLUE}
   echo $GREEN"Chapter 3 processed"
 
   showDoCmd "./tbb balances list" $YELLOW
@@ -92,44 +110,33 @@ fi
 if [ $chapter -ge 4 ]; then
   echo $WHITE"Running Chapter 4 - BabaYaga pays rent to Caesar and Andrej takes his cut"
   # Rent payment
-  showDoCmd "./tbb tx add --from=babayaga --to=caesar --value=1000 --data=rent" ${LIME_YELLOW}
+  tx_add $datad $babayaga $caesar 1000 rent ${LIME_YELLOW}
   if [ $chapter -eq 4 ]; then showDoCmd "./tbb balances list";fi
 
   # Hidden transaction charge
-  showDoCmd "./tbb tx add --from=babayaga --to=andrej --value=50 --data=hidden_fee" ${RED}
+  tx_add $datad $babayaga $andrej 50 hidden_fee ${RED}
   if [ $chapter -eq 4 ]; then showDoCmd "./tbb balances list";fi
 
-  # Another rewarding day
-  showDoCmd "./tbb tx add --from=andrej --to=andrej --value=100 --data=reward" ${POWDER_BLUE}
   echo $GREEN"Chapter 4 processed"
   showDoCmd "./tbb balances list"
 
   if [ $chapter -eq 4 ]; then showDoCmd "./tbb balances state";fi
+  if [ $chapter -eq 4 ]; then showDoCmd "./tbb account history $babayaga";fi
 fi
 
 if [ $chapter -ge 8 ]; then
-  ## tx_postman 1:port 2:from 3:to 4:value 4:data 6:colour
-  tx_postman () {
-    cmd=$'curl -s --location --request POST \'http:/localhost:'$1$'/tx/add\'
-    --header \'Content-Type: application/json\'
-    --data-raw \'{"from": "'$2$'","to": "'$3$'","value": '$4$',"data": "'$5$'"}\''
-  echo "*** $2 transfers $4 to $3 for $5 ***"
-  eval $cmd
-  echo
-  #bash -c "$cmd"
-  }
+  # Transactions are signed so they're sent with the CLI, which routes them to the running node
   echo $WHITE"Running Chapter 8 - Andrej pays BabaYaga 100 units via the RESTful API and rewards himself for the new solution"
   if [ $chapter -eq 8 ]; then echo "${WHITE}Starting the node";fi
   ## Leave andre to have the default data directory so the previous transactions from test 3 & 4 are used
-  showDoCmd "./tbb run --port=8080 &" $GREEN
+  showDoCmd "./tbb run --port=8080 --miner=$andrej &" $GREEN
   sleep 1
   if [ $chapter -eq 8 ]; then showDoCmd "curl -s --http2 http://localhost:8080/balances/list | json_pp" $CYAN;fi
-  tx_postman 8080 andrej babayaga 100 gift $POWDER_BLUE
+  tx_add $datad $andrej $babayaga 100 gift $POWDER_BLUE
   ## This next line shows the wrong balance because the state is persisted in memory of other the API process
   if [ $chapter -eq 8 ]; then showDoCmd "curl -s --http2 http://localhost:8080/balances/list | json_pp";fi
-  ## Burn out compensation
-  showDoCmd "./tbb tx add --from=andrej --to=andrej --value=24700 --data=reward" ${POWDER_BLUE}
-  if [ $chapter -eq 8 ]; then echo $GREEN"Burn out compensation added";fi
+  ## There's no burn out compensation, rewards only come from mining blocks
+  sleep 12
   echo $GREEN"Chapter 8 processed"
   showDoCmd "./tbb balances list"
 fi
@@ -144,19 +151,25 @@ if [ $chapter -ge 10 ]; then
   showDoCmd "curl -s --http2 curl -X GET http://localhost:8080/node/status | json_pp" $CYAN
 
   echo "${CYAN}Creating 2 more nodes in background"
-  showDoCmd "./tbb run --datadir=$datad/babayaga --port=8081 &" $YELLOW
+  # Every node of the chain needs the same genesis file, and the keys to send from its data dir
+  for d in babayaga caesar; do
+    mkdir -p $datad/$d/db
+    cp $datad/db/genesis.json $datad/$d/db/genesis.json
+    cp -R $datad/keystore $datad/$d/keystore
+  done
+  showDoCmd "./tbb run --datadir=$datad/babayaga --port=8081 --miner=$babayaga &" $YELLOW
   sleep 2
-  showDoCmd "./tbb run --datadir=$datad/caesar --port=8082 &" $CYAN
+  showDoCmd "./tbb run --datadir=$datad/caesar --port=8082 --miner=$caesar --store=segmented &" $CYAN
   sleep 2
   showBalances
   echo "${WHITE}Waiting 50 seconds to watch synch checks"
   sleep 50
   showBalances
   sleep 10
-  tx_postman 8080 andrej babayaga 100 FirstCustomerAward $POWDER_BLUE
+  tx_add $datad $andrej $babayaga 100 FirstCustomerAward $POWDER_BLUE
   showBalances
   sleep 15
-  tx_postman 8081 babayaga andrej 5 vodkas $POWDER_BLUE
+  tx_add $datad/babayaga $babayaga $andrej 5 vodkas $POWDER_BLUE
   showBalances
   echo "${WHITE}Waiting 25 seconds to watch synch checks"
   sleep 25
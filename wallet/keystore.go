@@ -0,0 +1,326 @@
+package wallet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"simpleblockchain/dao"
+	"sort"
+	"strings"
+)
+
+const keyFileExt = ".json"
+
+// The scrypt parameters used to turn a passphrase into an encryption key
+// They are stored in each key file so they can be raised without breaking older keys
+const scryptN = 1 << 15
+const scryptR = 8
+const scryptP = 1
+const scryptKeyLen = 32
+const saltLen = 32
+
+const kdfScrypt = "scrypt"
+const cipherAesGcm = "aes-256-gcm"
+
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// ErrUnencryptedKey is a key written before the keystore was encrypted, it needs encrypting before it's used
+var ErrUnencryptedKey = errors.New("the key isn't encrypted")
+
+// Key is an account and the private key that controls it
+type Key struct {
+	Account    dao.Account
+	PrivateKey ed25519.PrivateKey
+}
+
+// This is what's written to the keystore, the private key is never written unencrypted
+// Key files from before the keystore was encrypted only have the address and the private key.
+type keyFile struct {
+	Account    dao.Account `json:"address"`
+	Crypto     cryptoJson  `json:"crypto"`
+	PrivateKey string      `json:"private_key,omitempty"` // Only read from an unencrypted key file
+}
+
+type cryptoJson struct {
+	Cipher     string     `json:"cipher"`
+	CipherText string     `json:"ciphertext"`
+	Nonce      string     `json:"nonce"`
+	KDF        string     `json:"kdf"`
+	KDFParams  scryptJson `json:"kdfparams"`
+}
+
+type scryptJson struct {
+	N      int    `json:"n"`
+	R      int    `json:"r"`
+	P      int    `json:"p"`
+	KeyLen int    `json:"keylen"`
+	Salt   string `json:"salt"`
+}
+
+// NewKey generates a new key pair and the account for it
+func NewKey() (Key, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Key{}, fmt.Errorf("Cannot generate a key: %w", err)
+	}
+
+	return Key{dao.NewAccountFromPublicKey(publicKey), privateKey}, nil
+}
+
+// NewKeyFromHex rebuilds the key from an exported private key
+func NewKeyFromHex(privateKeyHex string) (Key, error) {
+	privateKey, err := hex.DecodeString(strings.TrimSpace(privateKeyHex))
+	if err != nil || len(privateKey) != ed25519.PrivateKeySize {
+		return Key{}, fmt.Errorf("A private key must be %d bytes of hex", ed25519.PrivateKeySize)
+	}
+
+	key := Key{PrivateKey: privateKey}
+	key.Account = dao.NewAccountFromPublicKey(key.PublicKey())
+
+	return key, nil
+}
+
+// PublicKey is the half of the key that can be shared
+func (k Key) PublicKey() ed25519.PublicKey {
+	return k.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// Hex is the private key in the form it's exported and imported
+func (k Key) Hex() string {
+	return hex.EncodeToString(k.PrivateKey)
+}
+
+// SignTx signs the transaction as the owner of the account
+func (k Key) SignTx(tx dao.Tx) (dao.SignedTx, error) {
+	if tx.From != k.Account {
+		return dao.SignedTx{}, fmt.Errorf("Key of '%s' can't sign for '%s'", k.Account, tx.From)
+	}
+
+	return dao.NewSignedTx(tx, k.PrivateKey), nil
+}
+
+// StoreKey encrypts the key with the passphrase and writes it into the keystore of the data dir
+func StoreKey(dataDir string, key Key, passphrase string) error {
+	keystoreDir := dao.GetKeystoreDirPath(dataDir)
+	if err := os.MkdirAll(keystoreDir, 0700); err != nil {
+		return fmt.Errorf("Error creating keystore directory: %w", err)
+	}
+
+	encrypted, err := encryptKey(key, passphrase)
+	if err != nil {
+		return fmt.Errorf("Cannot encrypt the key of '%s': %w", key.Account, err)
+	}
+
+	keyJson, err := json.MarshalIndent(encrypted, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot convert key to json: %w", err)
+	}
+
+	// Write alongside and rename so an existing key is never left half written
+	keyFilePath := getKeyFilePath(dataDir, key.Account)
+	err = ioutil.WriteFile(keyFilePath+".tmp", keyJson, 0600)
+	if err != nil {
+		return fmt.Errorf("Cannot write key file '%s': %w", keyFilePath, err)
+	}
+	err = os.Rename(keyFilePath+".tmp", keyFilePath)
+	if err != nil {
+		return fmt.Errorf("Cannot write key file '%s': %w", keyFilePath, err)
+	}
+
+	return nil
+}
+
+// LoadKey reads the key of the account from the keystore of the data dir and decrypts it
+// An unencrypted key is refused with ErrUnencryptedKey until ChangePassphrase encrypts it.
+func LoadKey(dataDir string, account dao.Account, passphrase string) (Key, error) {
+	loadedKeyFile, err := readKeyFile(dataDir, account)
+	if err != nil {
+		return Key{}, err
+	}
+	if loadedKeyFile.PrivateKey != "" {
+		return Key{}, fmt.Errorf("Key file of '%s' is from before keys were encrypted, encrypt it with 'tbb wallet change-passphrase %s' and an empty passphrase: %w", account, account, ErrUnencryptedKey)
+	}
+
+	key, err := decryptKey(loadedKeyFile, passphrase)
+	if err != nil {
+		return Key{}, fmt.Errorf("Cannot decrypt the key of '%s': %w", account, err)
+	}
+
+	if key.Account != account {
+		return Key{}, fmt.Errorf("Key file of '%s' holds the key of another account", account)
+	}
+
+	return key, nil
+}
+
+// ChangePassphrase encrypts the key of the account again with a new passphrase
+// An unencrypted key has no passphrase, it's encrypted for the first time whatever the passphrase is.
+func ChangePassphrase(dataDir string, account dao.Account, passphrase string, newPassphrase string) error {
+	key, err := LoadKey(dataDir, account, passphrase)
+	if errors.Is(err, ErrUnencryptedKey) {
+		key, err = loadUnencryptedKey(dataDir, account)
+	}
+	if err != nil {
+		return err
+	}
+
+	return StoreKey(dataDir, key, newPassphrase)
+}
+
+func readKeyFile(dataDir string, account dao.Account) (keyFile, error) {
+	content, err := ioutil.ReadFile(getKeyFilePath(dataDir, account))
+	if err != nil {
+		return keyFile{}, fmt.Errorf("Account '%s' is not in the keystore: %w", account, err)
+	}
+
+	var loadedKeyFile keyFile
+	err = json.Unmarshal(content, &loadedKeyFile)
+	if err != nil {
+		return keyFile{}, fmt.Errorf("Cannot interpret key file of '%s': %w", account, err)
+	}
+
+	return loadedKeyFile, nil
+}
+
+// Read a key written before the keystore was encrypted
+func loadUnencryptedKey(dataDir string, account dao.Account) (Key, error) {
+	loadedKeyFile, err := readKeyFile(dataDir, account)
+	if err != nil {
+		return Key{}, err
+	}
+
+	key, err := NewKeyFromHex(loadedKeyFile.PrivateKey)
+	if err != nil {
+		return Key{}, fmt.Errorf("Key file of '%s' has an invalid private key", account)
+	}
+	if key.Account != account {
+		return Key{}, fmt.Errorf("Key file of '%s' holds the key of another account", account)
+	}
+
+	return key, nil
+}
+
+// ListAccounts lists the accounts that have a key in the keystore of the data dir
+func ListAccounts(dataDir string) ([]dao.Account, error) {
+	files, err := ioutil.ReadDir(dao.GetKeystoreDirPath(dataDir))
+	if os.IsNotExist(err) {
+		return []dao.Account{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the keystore: %w", err)
+	}
+
+	accounts := make([]dao.Account, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != keyFileExt {
+			continue
+		}
+		account, err := dao.ParseAccount(strings.TrimSuffix(f.Name(), keyFileExt))
+		if err != nil {
+			continue
+		}
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i] < accounts[j] })
+
+	return accounts, nil
+}
+
+func getKeyFilePath(dataDir string, account dao.Account) string {
+	return filepath.Join(dao.GetKeystoreDirPath(dataDir), string(account)+keyFileExt)
+}
+
+// The private key is sealed with AES-GCM using a key derived from the passphrase with scrypt
+// GCM authenticates the ciphertext so a wrong passphrase is detected rather than giving a wrong key
+func encryptKey(key Key, passphrase string) (keyFile, error) {
+	params := scryptJson{N: scryptN, R: scryptR, P: scryptP, KeyLen: scryptKeyLen}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return keyFile{}, err
+	}
+	params.Salt = hex.EncodeToString(salt)
+
+	gcm, err := newCipher(passphrase, params)
+	if err != nil {
+		return keyFile{}, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return keyFile{}, err
+	}
+
+	cipherText := gcm.Seal(nil, nonce, key.PrivateKey, []byte(key.Account))
+
+	return keyFile{key.Account, cryptoJson{
+		Cipher:     cipherAesGcm,
+		CipherText: hex.EncodeToString(cipherText),
+		Nonce:      hex.EncodeToString(nonce),
+		KDF:        kdfScrypt,
+		KDFParams:  params,
+	}, ""}, nil
+}
+
+func decryptKey(kf keyFile, passphrase string) (Key, error) {
+	if kf.Crypto.Cipher != cipherAesGcm || kf.Crypto.KDF != kdfScrypt {
+		return Key{}, fmt.Errorf("unsupported cipher '%s' with kdf '%s'", kf.Crypto.Cipher, kf.Crypto.KDF)
+	}
+
+	cipherText, err := hex.DecodeString(kf.Crypto.CipherText)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid ciphertext: %w", err)
+	}
+	nonce, err := hex.DecodeString(kf.Crypto.Nonce)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid nonce: %w", err)
+	}
+
+	gcm, err := newCipher(passphrase, kf.Crypto.KDFParams)
+	if err != nil {
+		return Key{}, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return Key{}, fmt.Errorf("the nonce must be %d bytes", gcm.NonceSize())
+	}
+
+	privateKey, err := gcm.Open(nil, nonce, cipherText, []byte(kf.Account))
+	if err != nil {
+		return Key{}, ErrWrongPassphrase
+	}
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return Key{}, fmt.Errorf("invalid private key")
+	}
+
+	key := Key{PrivateKey: privateKey}
+	key.Account = dao.NewAccountFromPublicKey(key.PublicKey())
+
+	return key, nil
+}
+
+func newCipher(passphrase string, params scryptJson) (cipher.AEAD, error) {
+	salt, err := hex.DecodeString(params.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+
+	derivedKey, err := scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P, params.KeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive a key from the passphrase: %w", err)
+	}
+
+	block, err := aes.NewCipher(derivedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,124 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"simpleblockchain/dao"
+	"strings"
+	"testing"
+)
+
+func TestStoreAndLoadKey(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreKey(dataDir, key, "vodka"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(getKeyFilePath(dataDir, key.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), key.Hex()) {
+		t.Error("the private key is stored unencrypted")
+	}
+
+	if _, err := LoadKey(dataDir, key.Account, "wodka"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("got %v with the wrong passphrase; want %v", err, ErrWrongPassphrase)
+	}
+
+	loaded, err := LoadKey(dataDir, key.Account, "vodka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, key) {
+		t.Errorf("got key of '%s'; want '%s'", loaded.Account, key.Account)
+	}
+
+	if err := ChangePassphrase(dataDir, key.Account, "vodka", "rum"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKey(dataDir, key.Account, "vodka"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("got %v with the old passphrase; want %v", err, ErrWrongPassphrase)
+	}
+	if _, err := LoadKey(dataDir, key.Account, "rum"); err != nil {
+		t.Errorf("cannot load with the new passphrase: %s", err)
+	}
+
+	accounts, err := ListAccounts(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []dao.Account{key.Account}; !reflect.DeepEqual(accounts, want) {
+		t.Errorf("got accounts %v; want %v", accounts, want)
+	}
+}
+
+func TestEncryptAnUnencryptedKey(t *testing.T) {
+	dataDir := t.TempDir()
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A key file from before the keystore was encrypted
+	if err := os.MkdirAll(dao.GetKeystoreDirPath(dataDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	unencrypted := fmt.Sprintf(`{"address": "%s", "private_key": "%s"}`, key.Account, key.Hex())
+	if err := ioutil.WriteFile(getKeyFilePath(dataDir, key.Account), []byte(unencrypted), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadKey(dataDir, key.Account, ""); !errors.Is(err, ErrUnencryptedKey) {
+		t.Errorf("got %v; want %v", err, ErrUnencryptedKey)
+	}
+
+	if err := ChangePassphrase(dataDir, key.Account, "", "vodka"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadKey(dataDir, key.Account, "vodka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, key) {
+		t.Errorf("got key of '%s'; want '%s'", loaded.Account, key.Account)
+	}
+	content, err := ioutil.ReadFile(getKeyFilePath(dataDir, key.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), key.Hex()) {
+		t.Error("the private key is still stored unencrypted")
+	}
+}
+
+func TestNewKeyFromHex(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := NewKeyFromHex(key.Hex() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(imported, key) {
+		t.Errorf("got key of '%s'; want '%s'", imported.Account, key.Account)
+	}
+
+	if _, err := NewKeyFromHex(key.Hex()[2:]); err == nil {
+		t.Error("a short key should fail")
+	}
+}